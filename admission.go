@@ -0,0 +1,174 @@
+package keyvadb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Returned by Add when the buffer is full and Options.FailFast is set
+var ErrBackpressure = errors.New("write buffer full")
+
+type BackpressureStats struct {
+	// Keys and bytes of values added but not yet flushed to the tree
+	Keys  int64
+	Bytes int64
+	// Number of Adds which waited for a flush and the total time waited
+	Stalls    uint64
+	StallTime time.Duration
+	// Number of Adds failed with ErrBackpressure
+	Rejections uint64
+}
+
+func (s BackpressureStats) String() string {
+	return fmt.Sprintf("Pending: %s keys %s Stalls: %s %s Rejections: %s", humanize.Comma(s.Keys), humanize.Bytes(uint64(s.Bytes)), humanize.Comma(int64(s.Stalls)), s.StallTime, humanize.Comma(int64(s.Rejections)))
+}
+
+// Limits the keys and bytes of values added but not yet flushed to the
+// tree. Every Add reserves its size before appending its value and the
+// reservation is released once a flush has written its key to the tree.
+type admission struct {
+	maxKeys  int64
+	maxBytes int64
+	sync.Mutex
+	stats BackpressureStats
+	// Closed and replaced whenever reservations are released
+	released chan struct{}
+	// Number of Adds waiting for a reservation
+	waiting int
+	// Totals of the reservations whose keys are in the buffer and of
+	// those released by flushes
+	buffered BackpressureStats
+	done     BackpressureStats
+	// Called after an acquire which stalled or was rejected
+	onThrottle func(waited time.Duration, err error)
+}
+
+func newAdmission(maxKeys uint64, maxBytes int64, onThrottle func(time.Duration, error)) *admission {
+	return &admission{
+		maxKeys:    int64(maxKeys),
+		maxBytes:   maxBytes,
+		released:   make(chan struct{}),
+		onThrottle: onThrottle,
+	}
+}
+
+// A value larger than the limit is admitted once nothing else is pending
+func (a *admission) fits(size int64) bool {
+	if a.stats.Keys == 0 {
+		return true
+	}
+	return a.stats.Keys < a.maxKeys && a.stats.Bytes+size <= a.maxBytes
+}
+
+// Reserves room for a value of size bytes, waiting for flushes unless
+// failFast is true
+func (a *admission) acquire(ctx context.Context, size int64, failFast bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	waited, throttled, err := a.reserve(ctx, size, failFast)
+	if throttled && a.onThrottle != nil {
+		a.onThrottle(waited, err)
+	}
+	return err
+}
+
+// Returns how long the reservation waited and whether it waited or was
+// rejected at all
+func (a *admission) reserve(ctx context.Context, size int64, failFast bool) (time.Duration, bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	var start time.Time
+	for !a.fits(size) {
+		if failFast {
+			a.stats.Rejections++
+			return 0, true, ErrBackpressure
+		}
+		if start.IsZero() {
+			start = time.Now()
+			a.stats.Stalls++
+		}
+		released := a.released
+		a.waiting++
+		a.Unlock()
+		var err error
+		select {
+		case <-released:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		a.Lock()
+		a.waiting--
+		if err != nil {
+			waited := time.Since(start)
+			a.stats.StallTime += waited
+			return waited, true, err
+		}
+	}
+	a.stats.Keys++
+	a.stats.Bytes += size
+	if start.IsZero() {
+		return 0, false, nil
+	}
+	waited := time.Since(start)
+	a.stats.StallTime += waited
+	return waited, true, nil
+}
+
+// Must be called with the lock held
+func (a *admission) release(keys, bytes int64) {
+	a.stats.Keys -= keys
+	a.stats.Bytes -= bytes
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// Releases the reservation of an Add which failed
+func (a *admission) cancel(size int64) {
+	a.Lock()
+	a.release(1, size)
+	a.Unlock()
+}
+
+// Records that the key of a reservation is in the buffer
+func (a *admission) buffer(size int64) {
+	a.Lock()
+	a.buffered.Keys++
+	a.buffered.Bytes += size
+	a.Unlock()
+}
+
+// Returns the totals of reservations in the buffer, to be passed to
+// flushed once the buffer has been written to the tree
+func (a *admission) mark() BackpressureStats {
+	a.Lock()
+	defer a.Unlock()
+	return a.buffered
+}
+
+func (a *admission) flushed(mark BackpressureStats) {
+	a.Lock()
+	defer a.Unlock()
+	if mark.Keys > a.done.Keys {
+		a.release(mark.Keys-a.done.Keys, mark.Bytes-a.done.Bytes)
+		a.done = mark
+	}
+}
+
+// True if any Add is waiting for a flush
+func (a *admission) stalled() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.waiting > 0
+}
+
+func (a *admission) Stats() BackpressureStats {
+	a.Lock()
+	defer a.Unlock()
+	return a.stats
+}
@@ -2,10 +2,16 @@ package keyvadb
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
+	"sync"
 )
 
-var balancerRandom = MustRand()
+// Shared by concurrent calls to Balance
+var balancerRandom = struct {
+	*rand.Rand
+	sync.Mutex
+}{Rand: MustRand()}
 
 var Balancers = []struct {
 	Name     string
@@ -49,7 +55,9 @@ func (b *BufferBalancer) Balance(n *Node, s KeySlice) (*Node, KeySlice) {
 		return n, nil
 	}
 	// Randomly select entries from union
+	balancerRandom.Lock()
 	picks := balancerRandom.Perm(len(union))[:n.MaxEntries()]
+	balancerRandom.Unlock()
 	sort.Ints(picks)
 	for i, pick := range picks {
 		n.UpdateEntry(i, union[pick])
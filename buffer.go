@@ -4,12 +4,15 @@ import "sync"
 
 type Buffer struct {
 	m map[Hash]*Key
+	// Hashes of keys which replace the value of any key in the tree
+	replace map[Hash]bool
 	sync.RWMutex
 }
 
 func NewBuffer(size uint64) *Buffer {
 	return &Buffer{
-		m: make(map[Hash]*Key, int(size)),
+		m:       make(map[Hash]*Key, int(size)),
+		replace: make(map[Hash]bool),
 	}
 }
 
@@ -20,6 +23,15 @@ func (b *Buffer) Get(hash Hash) *Key {
 	return key
 }
 
+// Returns the buffered key for hash, if any, and whether it was added
+// with Replace
+func (b *Buffer) Lookup(hash Hash) (*Key, bool) {
+	b.RLock()
+	key, replace := b.m[hash], b.replace[hash]
+	b.RUnlock()
+	return key, replace
+}
+
 func (b *Buffer) Keys() KeySlice {
 	var keys KeySlice
 	b.RLock()
@@ -37,18 +49,48 @@ func (b *Buffer) Len() int {
 	return length
 }
 
+// Adds a key which leaves the value of any key in the tree unchanged,
+// even if it was buffered with Replace
 func (b *Buffer) Add(key *Key) uint64 {
 	b.Lock()
 	b.m[key.Hash] = key
+	delete(b.replace, key.Hash)
 	length := uint64(len(b.m))
 	b.Unlock()
 	return length
 }
 
+// Adds a key which replaces the value of any key in the tree
+func (b *Buffer) Replace(key *Key) uint64 {
+	b.Lock()
+	b.m[key.Hash] = key
+	b.replace[key.Hash] = true
+	length := uint64(len(b.m))
+	b.Unlock()
+	return length
+}
+
+// Returns those of keys which were added with Replace
+func (b *Buffer) Replacements(keys KeySlice) KeySlice {
+	var replacements KeySlice
+	b.RLock()
+	for _, key := range keys {
+		if b.replace[key.Hash] {
+			replacements = append(replacements, key)
+		}
+	}
+	b.RUnlock()
+	return replacements
+}
+
+// Keys which have since been added again with a different value are kept
 func (b *Buffer) Remove(keys KeySlice) {
 	b.Lock()
 	for _, key := range keys {
-		delete(b.m, key.Hash)
+		if current, ok := b.m[key.Hash]; ok && current.Id == key.Id {
+			delete(b.m, key.Hash)
+			delete(b.replace, key.Hash)
+		}
 	}
 	b.Unlock()
 }
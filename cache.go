@@ -8,56 +8,324 @@ import (
 	"github.com/dustin/go-humanize"
 )
 
+// Split into independently locked shards each managed with the
+// Adaptive Replacement Cache policy weighted by entry size
+type shardedCache struct {
+	shards []*cacheShard
+}
+
+// Cache of nodes by id
 type Cache struct {
-	m         map[NodeId]*list.Element
-	l         *list.List
-	size      int
-	hits      uint64
-	misses    uint64
-	evictions uint64
-	sync.RWMutex
+	shardedCache
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Bytes of nodes held
+	Resident int64
+	// Bytes of nodes that may be held
+	Capacity int64
+}
+
+func (s *CacheStats) Add(b CacheStats) {
+	s.Hits += b.Hits
+	s.Misses += b.Misses
+	s.Evictions += b.Evictions
+	s.Resident += b.Resident
+	s.Capacity += b.Capacity
 }
 
-func NewCache(size int) *Cache {
-	return &Cache{
-		m:    make(map[NodeId]*list.Element, size),
-		l:    list.New(),
-		size: size,
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
 	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%s/%s Hits: %0.2f%% Evictions: %s", humanize.Bytes(uint64(s.Resident)), humanize.Bytes(uint64(s.Capacity)), s.HitRate()*100, humanize.Comma(int64(s.Evictions)))
+}
+
+// Capacity is split evenly between shards
+func newShardedCache(capacity int64, shards int) shardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	var c shardedCache
+	for i := 0; i < shards; i++ {
+		c.shards = append(c.shards, newCacheShard(capacity/int64(shards)))
+	}
+	return c
+}
+
+func (c *shardedCache) shard(key uint64) *cacheShard {
+	// Fibonacci hashing spreads block aligned ids
+	return c.shards[(key*0x9E3779B97F4A7C15>>32)%uint64(len(c.shards))]
+}
+
+// Empties every shard, statistics are kept
+func (c *shardedCache) clear() {
+	for _, shard := range c.shards {
+		shard.clear()
+	}
+}
+
+func (c *shardedCache) Stats() []CacheStats {
+	stats := make([]CacheStats, len(c.shards))
+	for i, shard := range c.shards {
+		stats[i] = shard.stats()
+	}
+	return stats
+}
+
+func (c *shardedCache) Total() CacheStats {
+	return totalCacheStats(c.Stats())
+}
+
+func totalCacheStats(stats []CacheStats) CacheStats {
+	var total CacheStats
+	for _, s := range stats {
+		total.Add(s)
+	}
+	return total
+}
+
+func NewCache(capacity int64, shards int) *Cache {
+	return &Cache{newShardedCache(capacity, shards)}
 }
 
 func (c *Cache) Get(id NodeId) *Node {
-	c.RLock()
-	defer c.RUnlock()
-	if e, ok := c.m[id]; ok {
-		c.hits++
-		c.l.MoveToFront(e)
-		return e.Value.(*Node)
-	}
-	c.misses++
+	if node, ok := c.shard(uint64(id)).get(uint64(id)); ok {
+		return node.(*Node)
+	}
 	return nil
 }
 
+// Set inserts or replaces a node
 func (c *Cache) Set(node *Node) {
-	c.Lock()
-	defer c.Unlock()
-	if e, ok := c.m[node.Id]; ok {
-		e.Value = node
-		c.l.MoveToFront(e)
+	c.shard(uint64(node.Id)).set(uint64(node.Id), node, node.Size(), true)
+}
+
+// Add inserts a node read from disk unless a newer version is held
+func (c *Cache) Add(node *Node) {
+	c.shard(uint64(node.Id)).set(uint64(node.Id), node, node.Size(), false)
+}
+
+// Writes counts the Sets to the shard holding id. A node read from disk
+// after calling Writes is passed to AddSince with the count returned.
+func (c *Cache) Writes(id NodeId) uint64 {
+	shard := c.shard(uint64(id))
+	shard.Lock()
+	defer shard.Unlock()
+	return shard.writes
+}
+
+// AddSince is Add unless there has been a Set to the shard holding the
+// node since writes was returned, as the node read may then be stale
+// even if the newer version has since been evicted
+func (c *Cache) AddSince(node *Node, writes uint64) {
+	c.shard(uint64(node.Id)).add(uint64(node.Id), node, node.Size(), writes)
+}
+
+func (c *Cache) String() string {
+	return fmt.Sprintf("Cache: %s Shards: %d", c.Total(), len(c.shards))
+}
+
+const (
+	recent = iota
+	frequent
+	recentGhost
+	frequentGhost
+)
+
+type cacheEntry struct {
+	key   uint64
+	value interface{}
+	size  int64
+	list  int
+}
+
+// Lists of recently and frequently used nodes and ghost lists of the
+// ids recently evicted from each which adapt the target size of recent
+type cacheShard struct {
+	m        map[uint64]*list.Element
+	lists    [4]*list.List
+	bytes    [4]int64
+	capacity int64
+	target   int64
+	// Number of calls to set which replace entries
+	writes uint64
+	CacheStats
+	sync.Mutex
+}
+
+func newCacheShard(capacity int64) *cacheShard {
+	s := &cacheShard{
+		capacity: capacity,
+	}
+	s.reset()
+	return s
+}
+
+func (s *cacheShard) reset() {
+	s.m = make(map[uint64]*list.Element)
+	for i := range s.lists {
+		s.lists[i] = list.New()
+		s.bytes[i] = 0
+	}
+	s.target = 0
+}
+
+func (s *cacheShard) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+}
+
+func (s *cacheShard) move(e *list.Element, to int) {
+	entry := e.Value.(*cacheEntry)
+	s.lists[entry.list].Remove(e)
+	s.bytes[entry.list] -= entry.size
+	entry.list = to
+	if to == recentGhost || to == frequentGhost {
+		entry.value = nil
+	}
+	s.m[entry.key] = s.lists[to].PushFront(entry)
+	s.bytes[to] += entry.size
+}
+
+func (s *cacheShard) remove(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	s.lists[entry.list].Remove(e)
+	s.bytes[entry.list] -= entry.size
+	delete(s.m, entry.key)
+}
+
+// Evicts the least recently used node of recent or frequent to its ghost list
+func (s *cacheShard) replace(frequentGhostHit bool) {
+	s.Evictions++
+	recentBytes := s.bytes[recent]
+	if s.lists[recent].Len() > 0 && (recentBytes > s.target || (frequentGhostHit && recentBytes == s.target) || s.lists[frequent].Len() == 0) {
+		s.move(s.lists[recent].Back(), recentGhost)
 		return
 	}
-	c.m[node.Id] = c.l.PushFront(node)
-	if c.l.Len() > c.size {
-		c.evictions++
-		last := c.l.Back()
-		c.l.Remove(last)
-		delete(c.m, last.Value.(*Node).Id)
+	s.move(s.lists[frequent].Back(), frequentGhost)
+}
+
+func (s *cacheShard) makeRoom(size int64, frequentGhostHit bool) {
+	for s.bytes[recent]+s.bytes[frequent]+size > s.capacity && s.lists[recent].Len()+s.lists[frequent].Len() > 0 {
+		s.replace(frequentGhostHit)
 	}
 }
 
-func (c *Cache) String() string {
-	c.RLock()
-	defer c.RUnlock()
-	hits := float64(c.hits) / float64(c.hits+c.misses) * 100
-	return fmt.Sprintf("Cache Size: %s Hits: %0.2f%% Evictions: %d", humanize.Comma(int64(len(c.m))), hits, c.evictions)
+func (s *cacheShard) trim(ghost int, limit int64) {
+	for s.bytes[ghost] > limit && s.lists[ghost].Len() > 0 {
+		s.remove(s.lists[ghost].Back())
+	}
+}
+
+func (s *cacheShard) get(key uint64) (interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.m[key]; ok {
+		if entry := e.Value.(*cacheEntry); entry.value != nil {
+			s.Hits++
+			s.move(e, frequent)
+			return entry.value, true
+		}
+	}
+	s.Misses++
+	return nil, false
+}
+
+// Inserts value, an existing value is only replaced if replace is true
+func (s *cacheShard) set(key uint64, value interface{}, size int64, replace bool) {
+	s.Lock()
+	defer s.Unlock()
+	if replace {
+		s.writes++
+	}
+	s.insert(key, value, size, replace)
+}
+
+// Inserts unless there have been more than writes replacing sets
+func (s *cacheShard) add(key uint64, value interface{}, size int64, writes uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.writes == writes {
+		s.insert(key, value, size, false)
+	}
+}
+
+func (s *cacheShard) insert(key uint64, value interface{}, size int64, replace bool) {
+	if size > s.capacity {
+		return
+	}
+	e, ok := s.m[key]
+	if !ok {
+		// Keep recent and its ghosts within capacity and all lists
+		// within twice capacity
+		s.trim(recentGhost, s.capacity-s.bytes[recent]-size)
+		s.trim(frequentGhost, 2*s.capacity-s.bytes[recent]-s.bytes[frequent]-s.bytes[recentGhost]-size)
+		s.makeRoom(size, false)
+		s.m[key] = s.lists[recent].PushFront(&cacheEntry{
+			key:   key,
+			value: value,
+			size:  size,
+			list:  recent,
+		})
+		s.bytes[recent] += size
+		return
+	}
+	entry := e.Value.(*cacheEntry)
+	switch entry.list {
+	case recent, frequent:
+		if replace {
+			s.bytes[entry.list] += size - entry.size
+			entry.value, entry.size = value, size
+		}
+		s.move(e, frequent)
+		s.makeRoom(0, false)
+		return
+	case recentGhost:
+		// Recent is too small
+		delta := size
+		if s.bytes[frequentGhost] > s.bytes[recentGhost] {
+			delta = size * s.bytes[frequentGhost] / s.bytes[recentGhost]
+		}
+		if s.target += delta; s.target > s.capacity {
+			s.target = s.capacity
+		}
+		s.remove(e)
+		s.makeRoom(size, false)
+	case frequentGhost:
+		// Frequent is too small
+		delta := size
+		if s.bytes[recentGhost] > s.bytes[frequentGhost] {
+			delta = size * s.bytes[recentGhost] / s.bytes[frequentGhost]
+		}
+		if s.target -= delta; s.target < 0 {
+			s.target = 0
+		}
+		s.remove(e)
+		s.makeRoom(size, true)
+	}
+	s.m[key] = s.lists[frequent].PushFront(&cacheEntry{
+		key:   key,
+		value: value,
+		size:  size,
+		list:  frequent,
+	})
+	s.bytes[frequent] += size
+}
+
+func (s *cacheShard) stats() CacheStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.CacheStats
+	stats.Resident = s.bytes[recent] + s.bytes[frequent]
+	stats.Capacity = s.capacity
+	return stats
 }
@@ -0,0 +1,87 @@
+package keyvadb
+
+import (
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestCache(c *C) {
+	size := NewNode(FirstHash, LastHash, 0, 84).Size()
+	cache := NewCache(size*100, 4)
+	for i := 0; i < 1000; i++ {
+		cache.Set(NewNode(FirstHash, LastHash, NodeId(i*NodeBlockSize), 84))
+		total := cache.Total()
+		c.Assert(total.Resident <= total.Capacity, Equals, true, Commentf("%s", total))
+	}
+	total := cache.Total()
+	c.Assert(total.Evictions > 0, Equals, true)
+	c.Assert(total.Resident > 0, Equals, true)
+	// Most recently set nodes are held
+	c.Assert(cache.Get(NodeId(999*NodeBlockSize)), NotNil)
+	c.Assert(cache.Get(0), IsNil)
+	total = cache.Total()
+	c.Assert(total.Hits, Equals, uint64(1))
+	c.Assert(total.Misses, Equals, uint64(1))
+	c.Assert(cache.Stats(), HasLen, 4)
+
+	// Add does not replace a newer node
+	node := NewNode(FirstHash, LastHash, NodeId(999*NodeBlockSize), 84)
+	stale := node.Clone()
+	node.Digest = LastHash
+	cache.Set(node)
+	cache.Add(stale)
+	c.Assert(cache.Get(node.Id).Digest, Equals, LastHash)
+
+	// Frequently used nodes survive a scan
+	hot := NodeId(2000 * NodeBlockSize)
+	cache.Set(NewNode(FirstHash, LastHash, hot, 84))
+	cache.Get(hot)
+	for i := 3000; i < 4000; i++ {
+		cache.Set(NewNode(FirstHash, LastHash, NodeId(i*NodeBlockSize), 84))
+	}
+	c.Assert(cache.Get(hot), NotNil)
+
+	// A node read before a Set is not added after the newer node is evicted
+	id := NodeId(5000 * NodeBlockSize)
+	writes := cache.Writes(id)
+	stale = NewNode(FirstHash, LastHash, id, 84)
+	cache.Set(NewNode(FirstHash, LastHash, id, 84))
+	for i := 6000; i < 7000; i++ {
+		cache.Set(NewNode(FirstHash, LastHash, NodeId(i*NodeBlockSize), 84))
+	}
+	c.Assert(cache.Get(id), IsNil)
+	cache.AddSince(stale, writes)
+	c.Assert(cache.Get(id), IsNil)
+	cache.AddSince(stale, cache.Writes(id))
+	c.Assert(cache.Get(id), NotNil)
+}
+
+func (s *KeyVaSuite) TestCacheConcurrency(c *C) {
+	size := NewNode(FirstHash, LastHash, 0, 84).Size()
+	cache := NewCache(size*50, 8)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				id := NodeId((i*(w+1))%200) * NodeBlockSize
+				if node := cache.Get(id); node != nil {
+					c.Check(node.Id, Equals, id)
+					continue
+				}
+				node := NewNode(FirstHash, LastHash, id, 84)
+				if i%2 == 0 {
+					cache.Set(node)
+				} else {
+					cache.Add(node)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	total := cache.Total()
+	c.Assert(total.Resident <= total.Capacity, Equals, true, Commentf("%s", total))
+	c.Assert(total.Hits+total.Misses, Equals, uint64(80000))
+}
@@ -11,6 +11,16 @@ const (
 	EmptyChild     = NodeId(0)
 	SyntheticValue = ValueId(math.MaxUint64)
 	NodeBlockSize  = 4096
+	// Start, End, Digest and Count
+	nodeHeaderSize = 3*HashSize + 8
+	// Format of node blocks, held in the top byte of Count. Blocks
+	// written before nodes held digests read as format 0.
+	nodeFormat = 1
+	countMask  = 1<<56 - 1
+	// Hash and ValueId
+	keySize = HashSize + 8
+	// Largest degree whose nodes fit in a NodeBlockSize block
+	MaxFileDegree = (NodeBlockSize - nodeHeaderSize + keySize) / (keySize + 8)
 )
 
 var (
@@ -18,6 +28,5 @@ var (
 	EmptyKey   = MustHash("0000000000000000000000000000000000000000000000000000000000000000")
 	FirstHash  = MustHash("0000000000000000000000000000000000000000000000000000000000000001")
 	LastHash   = MustHash("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
-	minBig     = big.NewInt(0).SetBytes(FirstHash[:])
 	maxBig     = big.NewInt(0).SetBytes(LastHash[:])
 )
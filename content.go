@@ -0,0 +1,30 @@
+package keyvadb
+
+import (
+	"context"
+	"fmt"
+)
+
+// Put adds value keyed by its SHA-512 half and returns the key. Values
+// already in the DB are not appended again.
+func (db *DB) Put(value []byte) (Hash, error) {
+	return db.PutContext(context.Background(), value)
+}
+
+func (db *DB) PutContext(ctx context.Context, value []byte) (Hash, error) {
+	hash := SHA512Half.HashKey(value)
+	if !db.ContentAddressed {
+		return hash, fmt.Errorf("Put requires ContentAddressed")
+	}
+	_, err := db.addUnique(ctx, hash, nil, value)
+	return hash, err
+}
+
+// With ContentAddressed every key written must be the SHA-512 half of
+// its value
+func (db *DB) checkContent(key Hash, value []byte) error {
+	if db.ContentAddressed && SHA512Half.HashKey(value) != key {
+		return ErrCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package keyvadb
+
+import (
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestContentAddressed(c *C) {
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, ContentAddressed: true})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(300)
+	c.Assert(err, IsNil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, kv := range kvs[:200] {
+				hash, err := db.Put(kv.Value)
+				c.Check(err, IsNil)
+				c.Check(hash, Equals, kv.Hash)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(db.Flush(), IsNil)
+	for _, kv := range kvs[:200] {
+		_, err := db.Put(kv.Value)
+		c.Assert(err, IsNil)
+		found, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.Value, DeepEquals, kv.Value)
+	}
+	c.Assert(db.values.Length(), Equals, int64(200))
+
+	// Every write path rejects a key which is not the hash of its value
+	key, value := kvs[200].Hash, kvs[201].Value
+	c.Assert(db.Add(key, value), Equals, ErrCorrupt)
+	_, err = db.AddUnique(key, value)
+	c.Assert(err, Equals, ErrCorrupt)
+	_, err = db.PutIfAbsent(key, value)
+	c.Assert(err, Equals, ErrCorrupt)
+	c.Assert(db.Upsert(key, value), Equals, ErrCorrupt)
+	_, err = db.CompareAndSwap(kvs[0].Hash, kvs[0].Hash, value)
+	c.Assert(err, Equals, ErrCorrupt)
+	db.Deduplicate = true
+	c.Assert(db.Add(key, value), Equals, ErrCorrupt)
+	c.Assert(db.values.Length(), Equals, int64(200))
+
+	// Values written before the DB was content addressed are checked
+	db.ContentAddressed = false
+	c.Assert(db.Add(key, value), IsNil)
+	db.ContentAddressed = true
+	_, err = db.Get(kvs[200].Hash)
+	c.Assert(err, Equals, ErrCorrupt)
+	c.Assert(db.Flush(), IsNil)
+	_, err = db.Get(kvs[200].Hash)
+	c.Assert(err, Equals, ErrCorrupt)
+
+	_, err = Open("", &Options{InMemory: true, ContentAddressed: true, KeyHasher: SHA256})
+	c.Assert(err, NotNil)
+	db, err = NewMemoryDB(10, 100, "Distance")
+	c.Assert(err, IsNil)
+	_, err = db.Put(kvs[0].Value)
+	c.Assert(err, NotNil)
+}
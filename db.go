@@ -1,7 +1,12 @@
 package keyvadb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,77 +16,184 @@ import (
 )
 
 func NewMemoryDB(degree, batch uint64, balancer string) (*DB, error) {
-	keys, values := NewMemoryKeyStore(), NewMemoryValueStore()
-	return newDB(&DBConfig{
-		degree:   degree,
-		batch:    batch,
-		balancer: balancer,
-		keys:     keys,
-		values:   values,
-		journal:  NewSimpleJournal("Simple Journal", keys, values),
+	return Open("", &Options{
+		InMemory:  true,
+		Degree:    degree,
+		BatchSize: batch,
+		Balancer:  balancer,
 	})
 }
 
+// NewFileDB caches the nodes of the top cacheLevels levels of the tree.
+// Other options take their defaults, see Open.
 func NewFileDB(degree, cacheLevels, batch uint64, balancer, filename string) (*DB, error) {
-	values, err := NewFileValueStore(filename)
+	return Open(filename, &Options{
+		Degree:    degree,
+		BatchSize: batch,
+		Balancer:  balancer,
+		CacheSize: levelsSize(degree, cacheLevels),
+	})
+}
+
+// Bytes of the nodes in the top levels of a full tree, -1 if there are none
+func levelsSize(degree, levels uint64) int64 {
+	if levels == 0 {
+		return -1
+	}
+	// Sum of consecutive powers of degree
+	nodes := (math.Pow(float64(degree), float64(levels)) - 1) / (float64(degree) - 1)
+	size := nodes * float64(NewNode(FirstHash, LastHash, RootNode, degree).Size())
+	if size >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(size)
+}
+
+// Open opens or creates the database stored in path.keys and path.values.
+// Unset options take their default values and nil opts uses DefaultOptions.
+func Open(path string, opts *Options) (*DB, error) {
+	conf, err := newDBConfig(path, opts.withDefaults())
 	if err != nil {
 		return nil, err
 	}
-	keys, err := NewFileKeyStore(degree, cacheLevels, filename)
+	db, err := newDB(conf)
 	if err != nil {
+		conf.close()
 		return nil, err
 	}
-	journal, err := NewFileJournal(filename, keys, values)
-	return newDB(&DBConfig{
-		degree:   degree,
-		batch:    batch,
-		balancer: balancer,
-		keys:     keys,
-		values:   values,
-		journal:  journal,
-	})
+	return db, nil
+}
+
+func newDBConfig(path string, opts *Options) (*DBConfig, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.InMemory {
+		keys, values := NewMemoryKeyStore(), NewMemoryValueStore()
+		journal := NewSimpleJournal("Simple Journal", keys, values)
+		journal.OnCommit = opts.Hooks.OnJournalCommit
+		return &DBConfig{
+			Options: *opts,
+			keys:    keys,
+			values:  values,
+			journal: journal,
+		}, nil
+	}
+	if err := recoverCompaction(path); err != nil {
+		return nil, err
+	}
+	generation, err := readGeneration(path)
+	if err != nil {
+		return nil, err
+	}
+	var values ValueStore
+	values, err = NewFileValueStore(path, opts.Mmap, opts.Sync)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyHasher(path, opts.KeyHasher, values.Length() == 0); err != nil {
+		values.Close()
+		return nil, err
+	}
+	if opts.ValueCacheSize > 0 {
+		values = NewCachedValueStore(values, opts.ValueCacheSize)
+	}
+	keys, err := NewFileKeyStore(opts.Degree, opts.CacheSize, opts.Mmap, path)
+	if err != nil {
+		values.Close()
+		return nil, err
+	}
+	journal, err := NewFileJournal(path, keys, values)
+	if err != nil {
+		values.Close()
+		keys.Close()
+		return nil, err
+	}
+	journal.OnCommit = opts.Hooks.OnJournalCommit
+	return &DBConfig{
+		name:       path,
+		Options:    *opts,
+		keys:       keys,
+		values:     values,
+		journal:    journal,
+		generation: generation,
+	}, nil
 }
 
 type DBConfig struct {
-	name     string
-	degree   uint64
-	batch    uint64
-	balancer string
-	keys     KeyStore
-	values   ValueStore
-	journal  Journal
+	name string
+	Options
+	keys    KeyStore
+	values  ValueStore
+	journal Journal
+	// Exclusive bounds of the hashes the tree holds, all hashes if empty
+	start Hash
+	end   Hash
+	// Number of completed compactions, see Generation
+	generation uint64
 }
 
 type DB struct {
 	*DBConfig
-	tree     *Tree
-	buffer   *Buffer
-	flushing chan bool
-	lastsync int64
-	inserts  uint64
+	tree      *Tree
+	buffer    *Buffer
+	flushing  chan bool
+	admission *admission
+	// Bloom filter over the hashes in the tree, nil if disabled
+	filter    *bloomFilter
+	inserts   uint64
+	flushLock sync.Mutex
+	// Set under flushLock when a compaction fails part way through writing
+	// the keys, after which nothing more is flushed until the DB is opened
+	// again and the compaction recovered
+	failed error
+	// Held exclusively while the value store is rewritten
+	compactLock sync.RWMutex
+	// Striped by the first byte of hashes, see keyLock
+	keyLocks [16]sync.Mutex
 }
 
+// Closes the stores of a configuration which newDB failed to open
+func (conf *DBConfig) close() {
+	conf.journal.Close()
+	conf.keys.Close()
+	conf.values.Close()
+}
+
+// Reports progress of long running operations
+type ProgressFunc func(done, total int64)
+
 func newDB(conf *DBConfig) (*DB, error) {
-	balancer, err := newBalancer(conf.balancer)
+	balancer, err := newBalancer(conf.Balancer)
 	if err != nil {
 		return nil, err
 	}
-	tree, err := NewTree(conf.degree, conf.keys, balancer)
+	if conf.start.Empty() && conf.end.Empty() {
+		conf.start, conf.end = FirstHash, LastHash
+	}
+	tree, err := newRangeTree(conf.Degree, conf.start, conf.end, conf.keys, balancer)
 	if err != nil {
 		return nil, err
 	}
+	tree.OnNodeAlloc = conf.Hooks.OnNodeAlloc
 	db := &DB{
-		tree:     tree,
-		buffer:   NewBuffer(conf.batch),
-		flushing: make(chan (bool), 1),
-		DBConfig: conf,
-		lastsync: int64(time.Second),
+		tree:      tree,
+		buffer:    NewBuffer(conf.BatchSize),
+		flushing:  make(chan (bool), 1),
+		admission: newAdmission(conf.MaxBufferedKeys, conf.MaxBufferedBytes, conf.Hooks.OnThrottle),
+		DBConfig:  conf,
+	}
+	if err := db.openFilter(); err != nil {
+		return nil, err
 	}
 	go db.flusher()
 	return db, nil
 }
 
 func (db *DB) Close() error {
+	if err := db.saveFilter(); err != nil {
+		return err
+	}
 	if err := db.values.Close(); err != nil {
 		return err
 	}
@@ -92,77 +204,539 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) Add(key Hash, value []byte) error {
+	return db.AddContext(context.Background(), key, value)
+}
+
+// AddContext waits for room in the buffer until ctx is done unless
+// Options.FailFast is set. With Options.Deduplicate an existing key is
+// skipped, AddUnique also reports whether it was.
+func (db *DB) AddContext(ctx context.Context, key Hash, value []byte) error {
+	return db.insert(ctx, key, nil, value)
+}
+
+// AddUnique adds value unless key is already buffered or in the tree and
+// returns whether it was added
+func (db *DB) AddUnique(key Hash, value []byte) (bool, error) {
+	return db.AddUniqueContext(context.Background(), key, value)
+}
+
+func (db *DB) AddUniqueContext(ctx context.Context, key Hash, value []byte) (bool, error) {
+	if err := db.checkContent(key, value); err != nil {
+		return false, err
+	}
+	return db.addUnique(ctx, key, nil, value)
+}
+
+// Skips existing keys if Options.Deduplicate is set
+func (db *DB) insert(ctx context.Context, key Hash, raw, value []byte) error {
+	if err := db.checkContent(key, value); err != nil {
+		return err
+	}
+	if db.Deduplicate {
+		_, err := db.addUnique(ctx, key, raw, value)
+		return err
+	}
+	return db.add(ctx, key, raw, value, false)
+}
+
+func (db *DB) addUnique(ctx context.Context, key Hash, raw, value []byte) (bool, error) {
+	lock := db.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	exists, err := db.exists(ctx, key)
+	switch {
+	case err != nil:
+		return false, err
+	case exists:
+		db.Metrics.Add(MetricDuplicates, 1)
+		return false, nil
+	}
+	return true, db.add(ctx, key, raw, value, false)
+}
+
+// Serialises checks of a key's existence or value with changes to it
+func (db *DB) keyLock(key Hash) *sync.Mutex {
+	return &db.keyLocks[int(key[0])%len(db.keyLocks)]
+}
+
+// True if hash is buffered or in the tree
+func (db *DB) exists(ctx context.Context, hash Hash) (bool, error) {
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	if db.buffer.Get(hash) != nil {
+		return true, nil
+	}
+	if !db.mayHave(hash) {
+		return false, nil
+	}
+	switch _, err := db.tree.GetContext(ctx, hash); err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Appends a value stored with its original key when there is a KeyHasher.
+// If replace is set the value replaces that of any key in the tree.
+func (db *DB) add(ctx context.Context, key Hash, raw, value []byte, replace bool) error {
+	start := time.Now()
+	if db.KeyHasher != nil {
+		value = encodeKeyed(raw, value)
+	}
+	size := int64(SizeOfKeyValue(value))
+	if err := db.admission.acquire(ctx, size, db.FailFast); err != nil {
+		return err
+	}
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
 	kv, err := db.values.Append(key, value)
 	if err != nil {
+		db.admission.cancel(size)
 		return err
 	}
 	atomic.AddUint64(&db.inserts, 1)
-	if length := db.buffer.Add(kv.CloneKey()); length > db.batch*3 {
-		//throttle
-		wait := time.Duration(atomic.LoadInt64(&db.lastsync)) / time.Duration(db.batch)
-		time.Sleep(wait)
+	if replace {
+		db.buffer.Replace(kv.CloneKey())
+	} else {
+		db.buffer.Add(kv.CloneKey())
 	}
+	db.admission.buffer(size)
+	db.Metrics.Add(MetricAppendedBytes, uint64(size))
+	db.observe(MetricAddSeconds, start)
 	return nil
 }
 
 func (db *DB) Get(hash Hash) (*KeyValue, error) {
-	if key := db.buffer.Get(hash); key != nil {
-		return db.values.Get(key.Id)
+	return db.GetContext(context.Background(), hash)
+}
+
+func (db *DB) GetContext(ctx context.Context, hash Hash) (*KeyValue, error) {
+	defer db.observe(MetricGetSeconds, time.Now())
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	key := db.buffer.Get(hash)
+	if key == nil {
+		if !db.mayHave(hash) {
+			return nil, ErrNotFound
+		}
+		var err error
+		if key, err = db.tree.GetContext(ctx, hash); err != nil {
+			return nil, err
+		}
+	}
+	return db.keyValue(ctx, key)
+}
+
+// MultiGet returns the value of each hash, or the error getting it, in
+// the order of hashes. The tree is searched once for all of them and the
+// values are read in the order they were appended.
+func (db *DB) MultiGet(hashes []Hash) ([]*KeyValue, []error) {
+	return db.MultiGetContext(context.Background(), hashes)
+}
+
+func (db *DB) MultiGetContext(ctx context.Context, hashes []Hash) ([]*KeyValue, []error) {
+	defer db.observe(MetricMultiGetSeconds, time.Now())
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	values := make([]*KeyValue, len(hashes))
+	errs := make([]error, len(hashes))
+	keys := make([]*Key, len(hashes))
+	var search HashSlice
+	for i, hash := range hashes {
+		switch key := db.buffer.Get(hash); {
+		case key != nil:
+			keys[i] = key
+		case db.mayHave(hash):
+			search = append(search, hash)
+		default:
+			errs[i] = ErrNotFound
+		}
+	}
+	search.Sort()
+	found, err := db.tree.MultiGetContext(ctx, search)
+	var order []int
+	for i, hash := range hashes {
+		switch {
+		case keys[i] != nil:
+		case errs[i] != nil:
+			continue
+		case err != nil:
+			errs[i] = err
+			continue
+		case found[hash] == nil:
+			errs[i] = ErrNotFound
+			continue
+		default:
+			keys[i] = found[hash]
+		}
+		order = append(order, i)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return keys[order[a]].Id < keys[order[b]].Id
+	})
+	for _, i := range order {
+		values[i], errs[i] = db.keyValue(ctx, keys[i])
 	}
-	key, err := db.tree.Get(hash)
+	return values, errs
+}
+
+// Reads a value unless ctx is done
+func (db *DB) value(ctx context.Context, id ValueId) (*KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.values.Get(id)
+}
+
+// Reads the value of key as returned to callers, with any original key
+// split off and, if content addressed, checked against the hash
+func (db *DB) keyValue(ctx context.Context, key *Key) (*KeyValue, error) {
+	kv, err := db.value(ctx, key.Id)
 	if err != nil {
 		return nil, err
 	}
-	return db.values.Get(key.Id)
+	if kv, err = db.decode(kv); err != nil {
+		return nil, err
+	}
+	if db.ContentAddressed && SHA512Half.HashKey(kv.Value) != key.Hash {
+		return nil, ErrCorrupt
+	}
+	return kv, nil
 }
 
 func (db *DB) flusher() {
 	flushing := false
-	tick := time.NewTicker(time.Second / 10)
+	tick := time.NewTicker(db.FlushInterval)
 	for {
 		select {
 		case flushing = <-db.flushing:
 			// flushing set
 		case <-tick.C:
-			if !flushing && uint64(db.buffer.Len()) >= db.batch {
+			if !flushing && (uint64(db.buffer.Len()) >= db.BatchSize || db.admission.stalled()) {
 				flushing = true
-				go db.flush()
+				go func() {
+					if err := db.Flush(); err != nil {
+						glog.Fatalf("Flush Error: %s Closing with result: %+v", err, db.Close())
+					}
+					db.flushing <- false
+				}()
 			}
 		}
 	}
 }
 
-func (db *DB) flush() {
+// Flush writes all buffered keys to the tree regardless of batch size
+func (db *DB) Flush() error {
+	return db.FlushContext(context.Background())
+}
+
+// FlushContext gives up if ctx is done before the tree is changed
+func (db *DB) FlushContext(ctx context.Context) error {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	return db.flush(ctx)
+}
+
+func (db *DB) flush(ctx context.Context) error {
+	if db.failed != nil {
+		return db.failed
+	}
 	start := time.Now()
+	mark := db.admission.mark()
 	keys := db.buffer.Keys()
+	if len(keys) == 0 {
+		db.admission.flushed(mark)
+		return nil
+	}
+	if db.Hooks.OnFlushStart != nil {
+		db.Hooks.OnFlushStart(len(keys))
+	}
+	err := db.flushKeys(ctx, keys)
+	duration := time.Now().Sub(start)
+	if db.Hooks.OnFlushDone != nil {
+		db.Hooks.OnFlushDone(len(keys), duration, err)
+	}
+	if err != nil {
+		return err
+	}
+	db.admission.flushed(mark)
+	db.Metrics.Observe(MetricFlushSeconds, duration.Seconds())
+	db.Metrics.Observe(MetricFlushKeys, float64(len(keys)))
+	db.Metrics.Set(MetricBufferKeys, float64(db.buffer.Len()))
+	rate := float64(len(keys)) / duration.Seconds()
+	glog.Infof("%s Flushed %s keys in %0.2f secs %02.f keys/sec", db, humanize.Comma(int64(len(keys))), duration.Seconds(), rate)
+	return nil
+}
+
+// Writes keys to the tree and commits the journal
+func (db *DB) flushKeys(ctx context.Context, keys KeySlice) error {
 	keys.Sort()
-	n, err := db.tree.Add(keys, db.journal)
+	n, err := db.tree.AddContext(ctx, keys, db.journal)
 	switch {
+	case err != nil && err == ctx.Err():
+		db.journal.Discard()
+		return err
 	case err != nil:
-		glog.Fatalf("Tree Add Error: %s Closing with result:%+v", err.Error(), db.Close())
+		db.journal.Discard()
+		return fmt.Errorf("Tree Add Error: %s", err)
 	case n != len(keys):
-		glog.Fatalf("Too few keys added: %d expected %d: %s Closing with result: %+v", n, len(keys), db.Close())
+		db.journal.Discard()
+		return fmt.Errorf("Too few keys added: %d expected %d", n, len(keys))
 	}
+	// Existing keys were skipped by the tree, so point those added with
+	// Replace at their new values in the same commit
+	if replacements := db.buffer.Replacements(keys); len(replacements) > 0 {
+		if _, err := db.tree.ReplaceContext(ctx, replacements, db.journal); err != nil {
+			db.journal.Discard()
+			if err == ctx.Err() {
+				return err
+			}
+			return fmt.Errorf("Tree Replace Error: %s", err)
+		}
+	}
+	committing := time.Now()
 	if err := db.journal.Commit(); err != nil {
-		glog.Fatalf("Commit Error: %s Closing with result: %+v", err, db.Close())
+		return fmt.Errorf("Commit Error: %s", err)
+	}
+	db.observe(MetricCommitSeconds, committing)
+	if err := db.updateFilter(ctx, keys); err != nil {
+		return fmt.Errorf("Filter Error: %s", err)
 	}
 	db.buffer.Remove(keys)
-	db.flushing <- false
-	duration := time.Now().Sub(start)
-	atomic.StoreInt64(&db.lastsync, int64(duration))
-	rate := float64(len(keys)) / duration.Seconds()
-	glog.Infof("%s Flushed %s keys in %0.2f secs %02.f keys/sec", db, humanize.Comma(int64(len(keys))), duration.Seconds(), rate)
+	return nil
+}
+
+// Sync forces both stores to disk
+func (db *DB) Sync() error {
+	if err := db.values.Sync(); err != nil {
+		return err
+	}
+	return db.keys.Sync()
+}
+
+func (db *DB) Summary() (*Summary, error) {
+	return db.SummaryContext(context.Background())
+}
+
+func (db *DB) SummaryContext(ctx context.Context) (*Summary, error) {
+	return NewSummaryContext(ctx, db.tree)
+}
+
+// Verify checks that every node is well formed and has a correct digest,
+// that keys are walked in order and that each key refers to a value with
+// a matching hash.
+// Progress is reported in keys.
+func (db *DB) Verify(progress ProgressFunc) error {
+	return db.VerifyContext(context.Background(), progress)
+}
+
+func (db *DB) VerifyContext(ctx context.Context, progress ProgressFunc) error {
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	var done, total int64
+	err := db.tree.EachContext(ctx, func(level int, n *Node) error {
+		if !n.SanityCheck() {
+			return fmt.Errorf("Node %d at level %d is not well formed", n.Id, level)
+		}
+		total += int64(n.Occupancy() - n.Synthetics())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.tree.CheckDigestsContext(ctx); err != nil {
+		return err
+	}
+	var previous Hash
+	return db.tree.WalkContext(ctx, FirstHash, LastHash, func(key *Key) error {
+		if !previous.Less(key.Hash) {
+			return fmt.Errorf("Key %s out of order after %s", key.Hash, previous)
+		}
+		previous = key.Hash
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		kv, err := db.values.Get(key.Id)
+		if err != nil {
+			return fmt.Errorf("Key %s: %s", key, err)
+		}
+		if !kv.Hash.Equals(key.Hash) {
+			return fmt.Errorf("Key %s refers to value for %s", key, kv.Hash)
+		}
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+		return nil
+	})
+}
+
+// Compact rewrites the value store keeping only values referenced by the
+// tree. Adds, Gets and Ranges block until it completes. Progress is
+// reported in units of the value store's Length. A file DB reopened after
+// the process stops during compaction finishes it if the new keys were
+// committed and otherwise discards it.
+func (db *DB) Compact(progress ProgressFunc) error {
+	return db.CompactContext(context.Background(), progress)
+}
+
+// CompactContext leaves the value store unchanged if ctx is done first
+func (db *DB) CompactContext(ctx context.Context, progress ProgressFunc) error {
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	if err := db.flush(ctx); err != nil {
+		return err
+	}
+	total := db.values.Length()
+	generation := db.Generation() + 1
+	var changed []*Node
+	var committed error
+	err := db.values.Compact(func(values ValueStore) error {
+		return db.tree.EachContext(ctx, func(level int, n *Node) error {
+			var current *Node
+			for i, key := range n.Keys {
+				if key.Empty() || key.Id.Synthetic() {
+					continue
+				}
+				kv, err := db.value(ctx, key.Id)
+				if err != nil {
+					return err
+				}
+				moved, err := values.Append(kv.Hash, kv.Value)
+				if err != nil {
+					return err
+				}
+				if current == nil {
+					current = n.Clone()
+				}
+				current.Keys[i].Id = moved.Id
+				if progress != nil {
+					progress(values.Length(), total)
+				}
+			}
+			if current != nil {
+				db.journal.Swap(current, n)
+				changed = append(changed, current)
+			}
+			return nil
+		})
+	}, func() error {
+		if db.InMemory {
+			return db.journal.Commit()
+		}
+		if err := writeCompactionMarker(db.name, generation, changed); err != nil {
+			return err
+		}
+		// The marker commits the compaction, so if the keys are only
+		// partly written they are written again when the DB is next
+		// opened, with the compacted values that are kept for it
+		committed = db.journal.Commit()
+		return committed
+	})
+	if committed != nil && !db.InMemory {
+		db.failed = fmt.Errorf("Compaction Commit Error: %s", committed)
+		return db.failed
+	}
+	if err != nil {
+		db.journal.Discard()
+		return err
+	}
+	atomic.StoreUint64(&db.generation, generation)
+	if db.InMemory {
+		return nil
+	}
+	// Flushes are only safe once the marker is gone, as opening the DB
+	// writes the keys it holds over any that follow it
+	err = writeGeneration(db.name, generation)
+	if err == nil {
+		err = removeCompactionMarker(db.name)
+	}
+	if err != nil {
+		db.failed = fmt.Errorf("Compaction Marker Error: %s", err)
+	}
+	return db.failed
+}
+
+// Returned by ScanGeneration once the value store has been compacted
+var ErrCompacted = errors.New("value store compacted")
+
+// Generation is the number of times the value store has been compacted.
+// Value ids, such as those returned by Scan, from one generation do not
+// refer to the same values in another.
+func (db *DB) Generation() uint64 {
+	return atomic.LoadUint64(&db.generation)
 }
 
 type KeyValueFunc func(*KeyValue)
 
 func (db *DB) All(f KeyValueFunc) error {
-	return db.values.Each(f)
+	return db.AllContext(context.Background(), f)
+}
+
+// AllContext visits every value in the order they were appended
+func (db *DB) AllContext(ctx context.Context, f KeyValueFunc) error {
+	_, err := db.ScanContext(ctx, 0, func(kv *KeyValue) error {
+		f(kv)
+		return nil
+	})
+	return err
+}
+
+// Scan visits values in the order they were appended starting at id and
+// returns the id at which to resume. Compact invalidates ids.
+func (db *DB) Scan(id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	return db.ScanContext(context.Background(), id, f)
+}
+
+func (db *DB) ScanContext(ctx context.Context, id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	return db.scan(ctx, id, f)
+}
+
+// ScanGeneration is Scan returning ErrCompacted instead of visiting any
+// values unless the value store is still at generation
+func (db *DB) ScanGeneration(generation uint64, id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	return db.ScanGenerationContext(context.Background(), generation, id, f)
+}
+
+func (db *DB) ScanGenerationContext(ctx context.Context, generation uint64, id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	if db.Generation() != generation {
+		return id, ErrCompacted
+	}
+	return db.scan(ctx, id, f)
+}
+
+func (db *DB) scan(ctx context.Context, id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	return db.values.Scan(id, func(kv *KeyValue) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		kv, err := db.decode(kv)
+		if err != nil {
+			return err
+		}
+		return f(kv)
+	})
 }
 
 func (db *DB) Range(start, end Hash, f KeyValueFunc) error {
-	return db.tree.Walk(start, end, func(key *Key) error {
-		kv, err := db.values.Get(key.Id)
+	return db.RangeContext(context.Background(), start, end, f)
+}
+
+func (db *DB) RangeContext(ctx context.Context, start, end Hash, f KeyValueFunc) error {
+	defer db.observe(MetricRangeSeconds, time.Now())
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	return db.tree.WalkContext(ctx, start, end, func(key *Key) error {
+		kv, err := db.keyValue(ctx, key)
 		if err != nil {
 			return err
 		}
@@ -171,7 +745,80 @@ func (db *DB) Range(start, end Hash, f KeyValueFunc) error {
 	})
 }
 
+// Count returns the number of flushed keys from start to end inclusive
+func (db *DB) Count(start, end Hash) (uint64, error) {
+	return db.CountContext(context.Background(), start, end)
+}
+
+func (db *DB) CountContext(ctx context.Context, start, end Hash) (uint64, error) {
+	return db.tree.CountContext(ctx, start, end)
+}
+
+// EstimateCount approximates Count by reading only the top levels of the
+// tree, see Tree.EstimateCount
+func (db *DB) EstimateCount(start, end Hash) (uint64, error) {
+	return db.EstimateCountContext(context.Background(), start, end)
+}
+
+func (db *DB) EstimateCountContext(ctx context.Context, start, end Hash) (uint64, error) {
+	return db.tree.EstimateCountContext(ctx, start, end)
+}
+
+// CacheStats returns the statistics of each shard of the node cache,
+// or nil if the keys are not cached
+func (db *DB) CacheStats() []CacheStats {
+	return cacheStats(db.keys)
+}
+
+// ValueCacheStats returns the statistics of each shard of the value
+// cache, or nil if the values are not cached
+func (db *DB) ValueCacheStats() []CacheStats {
+	return cacheStats(db.values)
+}
+
+func cacheStats(store interface{}) []CacheStats {
+	if cached, ok := store.(interface {
+		CacheStats() []CacheStats
+	}); ok {
+		return cached.CacheStats()
+	}
+	return nil
+}
+
+func (db *DB) observe(name string, start time.Time) {
+	db.Metrics.Observe(name, since(start))
+}
+
+// CollectMetrics sets the gauges and counters which are maintained by
+// the DB rather than reported as they change. Call before publishing.
+func (db *DB) CollectMetrics() {
+	db.Metrics.Set(MetricBufferKeys, float64(db.buffer.Len()))
+	backpressure := db.BackpressureStats()
+	db.Metrics.Set(MetricPendingBytes, float64(backpressure.Bytes))
+	db.Metrics.Set(MetricStalls, float64(backpressure.Stalls))
+	db.Metrics.Set(MetricStallSeconds, backpressure.StallTime.Seconds())
+	db.Metrics.Set(MetricRejections, float64(backpressure.Rejections))
+	if stats := db.CacheStats(); stats != nil {
+		total := totalCacheStats(stats)
+		db.Metrics.Set(MetricCacheHits, float64(total.Hits))
+		db.Metrics.Set(MetricCacheMisses, float64(total.Misses))
+		db.Metrics.Set(MetricCacheEvictions, float64(total.Evictions))
+		db.Metrics.Set(MetricCacheResidentBytes, float64(total.Resident))
+	}
+	if stats := db.ValueCacheStats(); stats != nil {
+		total := totalCacheStats(stats)
+		db.Metrics.Set(MetricValueCacheHits, float64(total.Hits))
+		db.Metrics.Set(MetricValueCacheMisses, float64(total.Misses))
+		db.Metrics.Set(MetricValueCacheEvictions, float64(total.Evictions))
+		db.Metrics.Set(MetricValueCacheResidentBytes, float64(total.Resident))
+	}
+}
+
+func (db *DB) BackpressureStats() BackpressureStats {
+	return db.admission.Stats()
+}
+
 func (db *DB) String() string {
 	inserts := humanize.Comma(int64(atomic.LoadUint64(&db.inserts)))
-	return fmt.Sprintf("DB: Inserts: %s Buffer: %d %s %s", inserts, db.buffer.Len(), db.values, db.keys)
+	return fmt.Sprintf("DB: Inserts: %s Buffer: %d %s %s %s", inserts, db.buffer.Len(), db.admission.Stats(), db.values, db.keys)
 }
@@ -1,7 +1,14 @@
 package keyvadb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
 	"os"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -39,3 +46,621 @@ func (s *KeyVaSuite) TestFileDB(c *C) {
 	c.Assert(err, IsNil)
 	s.fillDB(10, 10000, db, c)
 }
+
+func (s *KeyVaSuite) TestCompact(c *C) {
+	db, err := NewMemoryDB(10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		for _, kv := range kvs {
+			c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		}
+		c.Assert(db.Flush(), IsNil)
+	}
+	c.Assert(db.values.Length(), Equals, int64(2000))
+	c.Assert(db.Verify(nil), IsNil)
+	var done, total int64
+	c.Assert(db.Compact(func(d, t int64) { done, total = d, t }), IsNil)
+	c.Assert(db.values.Length(), Equals, int64(1000))
+	c.Assert(done > 0 && done <= total, Equals, true)
+	c.Assert(db.Verify(nil), IsNil)
+	for _, kv := range kvs {
+		result, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(result.Value, DeepEquals, kv.Value)
+	}
+}
+
+// A file DB reopened after compaction was interrupted finishes it only if
+// the new keys were committed
+func (s *KeyVaSuite) TestCompactRecovery(c *C) {
+	for _, file := range []string{"recovery.keys", "recovery.values", "recovery.values.compact", "recovery.compacting", "recovery.generation", "recovery.hasher", "saved.keys", "saved.values"} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	copyFile := func(from, to string) {
+		b, err := ioutil.ReadFile(from)
+		c.Assert(err, IsNil)
+		c.Assert(ioutil.WriteFile(to, b, 0666), IsNil)
+	}
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	db, err := Open("recovery", nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		for _, kv := range kvs {
+			c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		}
+		c.Assert(db.Flush(), IsNil)
+	}
+	c.Assert(db.Close(), IsNil)
+	copyFile("recovery.keys", "saved.keys")
+	copyFile("recovery.values", "saved.values")
+	db, err = Open("recovery", nil)
+	c.Assert(err, IsNil)
+	c.Assert(db.Compact(nil), IsNil)
+	c.Assert(db.Generation(), Equals, uint64(1))
+	var nodes []*Node
+	c.Assert(db.tree.Each(func(level int, n *Node) error {
+		nodes = append(nodes, n)
+		return nil
+	}), IsNil)
+	length := db.values.Length()
+	c.Assert(db.Close(), IsNil)
+	check := func() {
+		db, err := Open("recovery", nil)
+		c.Assert(err, IsNil)
+		c.Assert(db.values.Length(), Equals, length)
+		c.Assert(db.Generation(), Equals, uint64(1))
+		c.Assert(db.Verify(nil), IsNil)
+		for _, kv := range kvs {
+			found, err := db.Get(kv.Hash)
+			c.Assert(err, IsNil)
+			c.Assert(found.Value, DeepEquals, kv.Value)
+		}
+		c.Assert(db.Close(), IsNil)
+	}
+
+	// Stopped after the marker was written but before the keys were
+	// synced and the compacted values renamed
+	c.Assert(os.Rename("recovery.values", "recovery.values.compact"), IsNil)
+	copyFile("saved.keys", "recovery.keys")
+	copyFile("saved.values", "recovery.values")
+	c.Assert(os.Remove("recovery.generation"), IsNil)
+	c.Assert(writeCompactionMarker("recovery", 1, nodes), IsNil)
+	check()
+	_, err = os.Stat("recovery.compacting")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// Stopped before the marker was written
+	c.Assert(ioutil.WriteFile("recovery.values.compact", []byte("partial"), 0666), IsNil)
+	check()
+	_, err = os.Stat("recovery.values.compact")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// Fails every Commit without writing anything
+type failingJournal struct {
+	Journal
+}
+
+func (j failingJournal) Commit() error {
+	return errors.New("commit failed")
+}
+
+func (s *KeyVaSuite) TestCompactCommitFailure(c *C) {
+	for _, file := range []string{"failure.keys", "failure.values", "failure.values.compact", "failure.compacting", "failure.generation", "failure.hasher"} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	db, err := Open("failure", nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		for _, kv := range kvs {
+			c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		}
+		c.Assert(db.Flush(), IsNil)
+	}
+	journal := db.journal
+	db.journal = failingJournal{journal}
+	c.Assert(db.Compact(nil), ErrorMatches, "Compaction Commit Error: commit failed")
+	c.Assert(db.Generation(), Equals, uint64(0))
+	db.journal = journal
+	// Nothing more is flushed over the keys the marker holds
+	more, err := gen.Take(10)
+	c.Assert(err, IsNil)
+	for _, kv := range more {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), ErrorMatches, "Compaction Commit Error: commit failed")
+	c.Assert(db.Compact(nil), ErrorMatches, "Compaction Commit Error: commit failed")
+	c.Assert(db.Close(), IsNil)
+
+	db, err = Open("failure", nil)
+	c.Assert(err, IsNil)
+	c.Assert(db.Generation(), Equals, uint64(1))
+	c.Assert(db.Verify(nil), IsNil)
+	for _, kv := range kvs {
+		found, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.Value, DeepEquals, kv.Value)
+	}
+	for _, kv := range more {
+		_, err := db.Get(kv.Hash)
+		c.Assert(err, Equals, ErrNotFound)
+	}
+	c.Assert(db.Close(), IsNil)
+	for _, file := range []string{"failure.compacting", "failure.values.compact"} {
+		_, err = os.Stat(file)
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *KeyVaSuite) TestScan(c *C) {
+	os.Remove("scan.values")
+	defer os.Remove("scan.values")
+	values, err := NewFileValueStore("scan", false, DefaultOptions().Sync)
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(100)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:50] {
+		_, err := values.Append(kv.Hash, kv.Value)
+		c.Assert(err, IsNil)
+	}
+	var scanned KeyValueSlice
+	collect := func(kv *KeyValue) error {
+		scanned = append(scanned, *kv)
+		return nil
+	}
+	next, err := values.Scan(0, collect)
+	c.Assert(err, IsNil)
+	c.Assert(int64(next), Equals, values.Length())
+	for _, kv := range kvs[50:] {
+		_, err := values.Append(kv.Hash, kv.Value)
+		c.Assert(err, IsNil)
+	}
+	next, err = values.Scan(next, collect)
+	c.Assert(err, IsNil)
+	c.Assert(int64(next), Equals, values.Length())
+	c.Assert(len(scanned), Equals, len(kvs))
+	for i, kv := range scanned {
+		c.Assert(kv.Hash, Equals, kvs[i].Hash)
+		c.Assert(kv.Value, DeepEquals, kvs[i].Value)
+		found, err := values.Get(kv.Id)
+		c.Assert(err, IsNil)
+		c.Assert(found.Hash, Equals, kv.Hash)
+		c.Assert(found.Id, Equals, kv.Id)
+	}
+	c.Assert(values.Close(), IsNil)
+}
+
+// A corrupt length is reported rather than allocated
+func (s *KeyVaSuite) TestCorruptLength(c *C) {
+	os.Remove("corrupt.values")
+	defer os.Remove("corrupt.values")
+	values, err := NewFileValueStore("corrupt", false, DefaultOptions().Sync)
+	c.Assert(err, IsNil)
+	defer values.Close()
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(10)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		_, err := values.Append(kv.Hash, kv.Value)
+		c.Assert(err, IsNil)
+	}
+	for _, length := range []uint64{1 << 62, uint64(values.Length()) + 1} {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], length)
+		f, err := os.OpenFile("corrupt.values", os.O_WRONLY, 0)
+		c.Assert(err, IsNil)
+		_, err = f.WriteAt(b[:], 0)
+		c.Assert(err, IsNil)
+		c.Assert(f.Close(), IsNil)
+		_, err = values.Get(0)
+		c.Assert(err, ErrorMatches, "Corrupt value length .*")
+		_, err = values.Scan(0, func(*KeyValue) error { return nil })
+		c.Assert(err, ErrorMatches, "Corrupt value length .*")
+		c.Assert(values.Each(func(*KeyValue) {}), ErrorMatches, "Corrupt value length .*")
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], 1<<62)
+	var kv KeyValue
+	_, err = kv.ReadFrom(bytes.NewReader(b[:]))
+	c.Assert(err, ErrorMatches, "Corrupt value length .*")
+}
+
+func (s *KeyVaSuite) TestReopenFileDB(c *C) {
+	os.Remove("reopen.values")
+	os.Remove("reopen.keys")
+	defer os.Remove("reopen.values")
+	defer os.Remove("reopen.keys")
+	defer os.Remove("reopen.hasher")
+	db, err := Open("reopen", &Options{BatchSize: 100000})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(db.Close(), IsNil)
+	db, err = Open("reopen", &Options{
+		BatchSize:      100000,
+		ValueCacheSize: 16 << 20,
+		Mmap:           true,
+		Sync:           SyncPolicy{Durability: GroupCommit},
+	})
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		result, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(result.Value, DeepEquals, kv.Value)
+	}
+	c.Assert(db.Close(), IsNil)
+}
+
+func (s *KeyVaSuite) TestValueCache(c *C) {
+	values := NewCachedValueStore(NewMemoryValueStore(), 1<<20)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(100)
+	c.Assert(err, IsNil)
+	var ids []ValueId
+	for _, kv := range kvs {
+		appended, err := values.Append(kv.Hash, kv.Value)
+		c.Assert(err, IsNil)
+		ids = append(ids, appended.Id)
+	}
+	for i := 0; i < 2; i++ {
+		for j, id := range ids {
+			kv, err := values.Get(id)
+			c.Assert(err, IsNil)
+			c.Assert(kv.Hash, Equals, kvs[j].Hash)
+		}
+	}
+	var total CacheStats
+	for _, stats := range values.CacheStats() {
+		total.Add(stats)
+	}
+	c.Assert(total.Misses, Equals, uint64(100))
+	c.Assert(total.Hits, Equals, uint64(100))
+	// Callers may modify the values returned
+	kv, err := values.Get(ids[0])
+	c.Assert(err, IsNil)
+	kv.Value[0]++
+	kv, err = values.Get(ids[0])
+	c.Assert(err, IsNil)
+	c.Assert(kv.Value, DeepEquals, kvs[0].Value)
+	// Compaction reuses ids so cached values must not be returned
+	err = values.Compact(func(compacted ValueStore) error {
+		for _, kv := range kvs[50:] {
+			if _, err := compacted.Append(kv.Hash, kv.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	c.Assert(err, IsNil)
+	kv, err = values.Get(ids[0])
+	c.Assert(err, IsNil)
+	c.Assert(kv.Hash, Equals, kvs[50].Hash)
+}
+
+func (s *KeyVaSuite) TestMappedFileDB(c *C) {
+	os.Remove("mapped.values")
+	os.Remove("mapped.keys")
+	defer os.Remove("mapped.values")
+	defer os.Remove("mapped.keys")
+	defer os.Remove("mapped.generation")
+	defer os.Remove("mapped.hasher")
+	db, err := Open("mapped", &Options{
+		CacheSize: 1 << 20,
+		Mmap:      true,
+		Sync:      SyncPolicy{Durability: Async},
+	})
+	c.Assert(err, IsNil)
+	s.fillDB(3, 10000, db, c)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Compact(nil), IsNil)
+	c.Assert(db.Verify(nil), IsNil)
+	for _, kv := range kvs {
+		result, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(result.Value, DeepEquals, kv.Value)
+	}
+	c.Assert(db.Close(), IsNil)
+}
+
+func (s *KeyVaSuite) TestOptions(c *C) {
+	opts := (&Options{Degree: 10}).withDefaults()
+	c.Assert(opts.Degree, Equals, uint64(10))
+	c.Assert(opts.BatchSize, Equals, DefaultOptions().BatchSize)
+	c.Assert(opts.Validate(), IsNil)
+	c.Assert(DefaultOptions().Validate(), IsNil)
+	// The node cache is disabled by a negative size
+	c.Assert((&Options{CacheSize: -1}).withDefaults().CacheSize, Equals, int64(0))
+	c.Assert(levelsSize(84, 0), Equals, int64(-1))
+	c.Assert(levelsSize(84, 2), Equals, 85*NewNode(FirstHash, LastHash, RootNode, 84).Size())
+	for _, invalid := range []*Options{
+		{Degree: 1},
+		{Degree: MaxFileDegree + 1},
+		{Balancer: "Unknown"},
+		{ValueCacheSize: -1},
+		{Sync: SyncPolicy{Durability: Async + 1}},
+		{FlushInterval: -1},
+	} {
+		_, err := Open("invalid", invalid)
+		c.Assert(err, NotNil, Commentf("%+v", invalid))
+	}
+	db, err := Open("", &Options{InMemory: true, Degree: MaxFileDegree + 1})
+	c.Assert(err, IsNil)
+	c.Assert(db.Degree, Equals, uint64(MaxFileDegree+1))
+}
+
+func (s *KeyVaSuite) TestBackpressure(c *C) {
+	db, err := Open("", &Options{
+		InMemory:         true,
+		Degree:           10,
+		BatchSize:        100,
+		MaxBufferedKeys:  100,
+		MaxBufferedBytes: 1 << 20,
+		FailFast:         true,
+		FlushInterval:    time.Hour,
+	})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(200)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:100] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Add(kvs[100].Hash, kvs[100].Value), Equals, ErrBackpressure)
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(db.Add(kvs[100].Hash, kvs[100].Value), IsNil)
+	stats := db.BackpressureStats()
+	c.Assert(stats.Keys, Equals, int64(1))
+	c.Assert(stats.Rejections, Equals, uint64(1))
+
+	// Blocking adds wait until cancelled or a flush releases room
+	db.FailFast = false
+	for _, kv := range kvs[101:200] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	extra := kvs[0]
+	c.Assert(db.AddContext(ctx, extra.Hash, extra.Value), Equals, context.DeadlineExceeded)
+	done := make(chan error)
+	go func() {
+		done <- db.Add(extra.Hash, extra.Value)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(<-done, IsNil)
+	stats = db.BackpressureStats()
+	c.Assert(stats.Stalls, Equals, uint64(2))
+	c.Assert(stats.StallTime > 0, Equals, true)
+	c.Assert(stats.Keys, Equals, int64(1))
+}
+
+func (s *KeyVaSuite) TestDeduplicate(c *C) {
+	registry := NewRegistry()
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, Deduplicate: true, Metrics: registry})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(200)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:100] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Add(kvs[0].Hash, kvs[1].Value), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	for _, kv := range kvs {
+		added, err := db.AddUnique(kv.Hash, kv.Value)
+		c.Assert(err, IsNil)
+		c.Assert(added, Equals, kv.Id > 100)
+	}
+	c.Assert(db.values.Length(), Equals, int64(200))
+	found, err := db.Get(kvs[0].Hash)
+	c.Assert(err, IsNil)
+	c.Assert(found.Value, DeepEquals, kvs[0].Value)
+	c.Assert(registry.Snapshot()[MetricDuplicates], Equals, uint64(101))
+}
+
+func (s *KeyVaSuite) TestMultiGet(c *C) {
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 1000, FlushInterval: time.Hour})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(3000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:2000] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	// Buffered, in the tree, missing and repeated
+	for _, kv := range kvs[2000:2500] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	var hashes []Hash
+	for i := len(kvs) - 1; i >= 0; i -= 3 {
+		hashes = append(hashes, kvs[i].Hash)
+	}
+	hashes = append(hashes, kvs[0].Hash, kvs[0].Hash)
+	values, errs := db.MultiGet(hashes)
+	c.Assert(values, HasLen, len(hashes))
+	c.Assert(errs, HasLen, len(hashes))
+	for i, hash := range hashes {
+		expected, err := db.Get(hash)
+		c.Assert(errs[i], Equals, err)
+		if err == nil {
+			c.Assert(values[i].Hash, Equals, hash)
+			c.Assert(values[i].Value, DeepEquals, expected.Value)
+		}
+	}
+	c.Assert(errs[0], Equals, ErrNotFound)
+	c.Assert(errs[len(errs)-1], IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, errs = db.MultiGetContext(ctx, hashes[:1])
+	c.Assert(errs[0], Equals, context.Canceled)
+}
+
+func (s *KeyVaSuite) TestCount(c *C) {
+	db, err := NewMemoryDB(10, 1000, "Distance")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(20000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	hashes := kvs.Keys().Hashes()
+	hashes.Sort()
+	for _, r := range [][2]int{{0, 19999}, {0, 0}, {5000, 14999}, {1234, 1300}} {
+		start, end := hashes[r[0]], hashes[r[1]]
+		count, err := db.Count(start, end)
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, uint64(r[1]-r[0]+1))
+	}
+	count, err := db.Count(hashes[10], hashes[9])
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint64(0))
+	estimate, err := db.EstimateCount(FirstHash, LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(estimate, Equals, uint64(20000))
+	// Half the hash space holds about half the keys
+	half := MustHash("8000000000000000000000000000000000000000000000000000000000000000")
+	estimate, err = db.EstimateCount(FirstHash, half)
+	c.Assert(err, IsNil)
+	count, err = db.Count(FirstHash, half)
+	c.Assert(err, IsNil)
+	c.Assert(math.Abs(float64(count)-float64(estimate)) < 500, Equals, true, Commentf("%d estimated as %d", count, estimate))
+	estimate, err = db.EstimateCount(half, FirstHash)
+	c.Assert(err, IsNil)
+	c.Assert(estimate, Equals, uint64(0))
+
+	// Every flush is reflected in the estimate
+	more, err := gen.Take(3000)
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		for _, kv := range more[i*1000 : (i+1)*1000] {
+			c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		}
+		c.Assert(db.Flush(), IsNil)
+		estimate, err = db.EstimateCount(FirstHash, LastHash)
+		c.Assert(err, IsNil)
+		c.Assert(estimate, Equals, uint64(20000+(i+1)*1000))
+	}
+}
+
+func (s *KeyVaSuite) TestHooks(c *C) {
+	var starts, flushed, committed, allocs, throttles int
+	db, err := Open("", &Options{
+		InMemory:        true,
+		Degree:          10,
+		BatchSize:       100,
+		MaxBufferedKeys: 100,
+		FailFast:        true,
+		FlushInterval:   time.Hour,
+		Hooks: Hooks{
+			OnFlushStart: func(keys int) {
+				starts++
+			},
+			OnFlushDone: func(keys int, duration time.Duration, err error) {
+				c.Check(err, IsNil)
+				flushed += keys
+			},
+			OnJournalCommit: func(deltas []Delta) {
+				for _, delta := range deltas {
+					committed += delta.NewKeys()
+				}
+			},
+			OnNodeAlloc: func(n *Node) {
+				c.Check(n.Id.Empty(), Equals, false)
+				allocs++
+			},
+			OnThrottle: func(waited time.Duration, err error) {
+				c.Check(err, Equals, ErrBackpressure)
+				throttles++
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(101)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:100] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Add(kvs[100].Hash, kvs[100].Value), Equals, ErrBackpressure)
+	c.Assert(throttles, Equals, 1)
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(starts, Equals, 1)
+	c.Assert(flushed, Equals, 100)
+	c.Assert(committed >= 100, Equals, true, Commentf("%d keys committed", committed))
+	c.Assert(allocs > 0, Equals, true)
+	c.Assert(db.Close(), IsNil)
+}
+
+func (s *KeyVaSuite) TestContext(c *C) {
+	db, err := NewMemoryDB(10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(db.AddContext(cancelled, kvs[0].Hash, kvs[0].Value), Equals, context.Canceled)
+	c.Assert(db.FlushContext(cancelled), Equals, context.Canceled)
+	c.Assert(db.buffer.Len(), Equals, len(kvs))
+	c.Assert(db.Flush(), IsNil)
+	_, err = db.GetContext(cancelled, kvs[0].Hash)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(db.VerifyContext(cancelled, nil), Equals, context.Canceled)
+	c.Assert(db.CompactContext(cancelled, nil), Equals, context.Canceled)
+
+	// Cancellation part way through a Range stops the walk
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err = db.RangeContext(ctx, FirstHash, LastHash, func(kv *KeyValue) {
+		if visited++; visited == 10 {
+			cancel()
+		}
+	})
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(visited, Equals, 10)
+
+	// A cancelled Compact leaves the database intact
+	ctx, cancel = context.WithCancel(context.Background())
+	compacted := 0
+	err = db.CompactContext(ctx, func(done, total int64) {
+		if compacted++; compacted == 10 {
+			cancel()
+		}
+	})
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(db.Verify(nil), IsNil)
+	for _, kv := range kvs {
+		result, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(result.Value, DeepEquals, kv.Value)
+	}
+}
@@ -0,0 +1,171 @@
+package keyvadb
+
+import (
+	"context"
+	"fmt"
+)
+
+// Ranges holding fewer keys than this on both sides are compared key by key
+const diffLeafSize = 256
+
+// Number of subranges a differing range is split into
+const diffFanout = 16
+
+// Summarises the keys between Start and End inclusive
+type RangeDigest struct {
+	Start  Hash
+	End    Hash
+	Digest Hash
+	Count  uint64
+}
+
+func (r *RangeDigest) Equals(b *RangeDigest) bool {
+	return r.Digest == b.Digest && r.Count == b.Count
+}
+
+func (r *RangeDigest) String() string {
+	return fmt.Sprintf("%s-%s:%d:%s", r.Start, r.End, r.Count, r.Digest)
+}
+
+// A database that can be compared with Diff, such as a DB or
+// a client of another process
+type Remote interface {
+	Digest(start, end Hash) (*RangeDigest, error)
+	Hashes(start, end Hash, f func(Hash) error) error
+}
+
+// Called for each hash present in only one of two databases,
+// local is true if the hash is only present in the local database
+type DiffFunc func(hash Hash, local bool) error
+
+// Digest summarises the flushed keys from start to end inclusive
+func (db *DB) Digest(start, end Hash) (*RangeDigest, error) {
+	return db.DigestContext(context.Background(), start, end)
+}
+
+func (db *DB) DigestContext(ctx context.Context, start, end Hash) (*RangeDigest, error) {
+	digest, count, err := db.tree.DigestContext(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &RangeDigest{
+		Start:  start,
+		End:    end,
+		Digest: digest,
+		Count:  count,
+	}, nil
+}
+
+// Hashes visits the flushed keys from start to end inclusive in order
+func (db *DB) Hashes(start, end Hash, f func(Hash) error) error {
+	return db.HashesContext(context.Background(), start, end, f)
+}
+
+func (db *DB) HashesContext(ctx context.Context, start, end Hash, f func(Hash) error) error {
+	return db.tree.WalkContext(ctx, start, end, func(key *Key) error {
+		return f(key.Hash)
+	})
+}
+
+func hashesInRange(ctx context.Context, r Remote, start, end Hash) (HashSlice, error) {
+	var hashes HashSlice
+	err := r.Hashes(start, end, func(hash Hash) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+		return nil
+	})
+	return hashes, err
+}
+
+// Calls f for each hash of r in the range, which the other side lacks
+func eachHash(ctx context.Context, r Remote, start, end Hash, local bool, f DiffFunc) error {
+	return r.Hashes(start, end, func(hash Hash) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return f(hash, local)
+	})
+}
+
+// Calls f for each hash in sorted a or b but not both
+func mergeDifference(a, b HashSlice, f DiffFunc) error {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Less(b[j])):
+			if err := f(a[i], true); err != nil {
+				return err
+			}
+			i++
+		case i == len(a) || b[j].Less(a[i]):
+			if err := f(b[j], false); err != nil {
+				return err
+			}
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+func diff(ctx context.Context, local, remote Remote, start, end Hash, f DiffFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l, err := local.Digest(start, end)
+	if err != nil {
+		return err
+	}
+	r, err := remote.Digest(start, end)
+	if err != nil {
+		return err
+	}
+	switch {
+	case l.Equals(r):
+		return nil
+	case l.Count == 0:
+		return eachHash(ctx, remote, start, end, false, f)
+	case r.Count == 0:
+		return eachHash(ctx, local, start, end, true, f)
+	case l.Count <= diffLeafSize && r.Count <= diffLeafSize:
+		a, err := hashesInRange(ctx, local, start, end)
+		if err != nil {
+			return err
+		}
+		b, err := hashesInRange(ctx, remote, start, end)
+		if err != nil {
+			return err
+		}
+		return mergeDifference(a, b, f)
+	}
+	stride := start.Stride(end, diffFanout)
+	for i := 0; i < diffFanout; i++ {
+		subEnd := end
+		if i < diffFanout-1 {
+			subEnd = start.Add(stride).Previous()
+		}
+		if err := diff(ctx, local, remote, start, subEnd, f); err != nil {
+			return err
+		}
+		start = subEnd.Add(FirstHash)
+	}
+	return nil
+}
+
+// Diff compares the flushed keys of db with those of remote by
+// recursively splitting the hash space into ranges and only descending
+// into ranges whose digests differ. f is called in hash order, possibly
+// while the hashes of a range are being read from remote, so must not
+// make requests of remote itself.
+func (db *DB) Diff(remote Remote, f DiffFunc) error {
+	return db.DiffContext(context.Background(), remote, f)
+}
+
+// DiffContext stops between requests to remote once ctx is done
+func (db *DB) DiffContext(ctx context.Context, remote Remote, f DiffFunc) error {
+	return diff(ctx, db, remote, FirstHash, LastHash, f)
+}
@@ -0,0 +1,118 @@
+package keyvadb
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestDiff(c *C) {
+	a, err := NewMemoryDB(10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	b, err := NewMemoryDB(10, 100000, "Buffer")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	common, err := gen.Take(5000)
+	c.Assert(err, IsNil)
+	onlyA, err := gen.Take(50)
+	c.Assert(err, IsNil)
+	onlyB, err := gen.Take(70)
+	c.Assert(err, IsNil)
+	for _, kv := range append(common, onlyA...) {
+		c.Assert(a.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(a.Flush(), IsNil)
+	// Different batches and balancer give b a different shape
+	for i, kv := range append(onlyB, common...) {
+		c.Assert(b.Add(kv.Hash, kv.Value), IsNil)
+		if i%1000 == 0 {
+			c.Assert(b.Flush(), IsNil)
+		}
+	}
+	c.Assert(b.Flush(), IsNil)
+	c.Assert(a.Verify(nil), IsNil)
+	c.Assert(b.Verify(nil), IsNil)
+	all, err := a.Digest(FirstHash, LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(all.Count, Equals, uint64(5050))
+	found := map[Hash]bool{}
+	err = a.Diff(b, func(hash Hash, local bool) error {
+		found[hash] = local
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(found), Equals, len(onlyA)+len(onlyB))
+	for _, kv := range onlyA {
+		c.Assert(found[kv.Hash], Equals, true)
+	}
+	for _, kv := range onlyB {
+		local, ok := found[kv.Hash]
+		c.Assert(ok && !local, Equals, true)
+	}
+	for _, kv := range onlyB {
+		c.Assert(a.Add(kv.Hash, kv.Value), IsNil)
+	}
+	for _, kv := range onlyA {
+		c.Assert(b.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(a.Flush(), IsNil)
+	c.Assert(b.Flush(), IsNil)
+	err = a.Diff(b, func(hash Hash, local bool) error {
+		c.Errorf("Unexpected difference %s %t", hash, local)
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	// Every hash of a is streamed in order against an empty database
+	empty, err := NewMemoryDB(10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	var previous Hash
+	n := 0
+	err = a.Diff(empty, func(hash Hash, local bool) error {
+		c.Assert(local, Equals, true)
+		c.Assert(previous.Less(hash), Equals, true)
+		previous = hash
+		n++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5120)
+}
+
+// Files written before nodes held digests have zeros in their place
+func (s *KeyVaSuite) TestRebuildDigests(c *C) {
+	for _, ext := range []string{".keys", ".values", ".hasher"} {
+		os.Remove("digests" + ext)
+		defer os.Remove("digests" + ext)
+	}
+	opts := &Options{Degree: 20, BatchSize: 1000}
+	db, err := Open("digests", opts)
+	c.Assert(err, IsNil)
+	s.fillDB(3, 1000, db, c)
+	c.Assert(db.Flush(), IsNil)
+	digest, err := db.Digest(FirstHash, LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	f, err := os.OpenFile("digests.keys", os.O_RDWR, 0666)
+	c.Assert(err, IsNil)
+	fi, err := f.Stat()
+	c.Assert(err, IsNil)
+	offset := int64(2*HashSize) + int64(opts.Degree-1)*keySize + int64(opts.Degree)*8
+	for block := int64(0); block < fi.Size(); block += NodeBlockSize {
+		_, err := f.WriteAt(make([]byte, HashSize+8), block+offset)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	db, err = Open("digests", opts)
+	c.Assert(err, IsNil)
+	c.Assert(db.tree.CheckDigests(), IsNil)
+	rebuilt, err := db.Digest(FirstHash, LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(rebuilt, DeepEquals, digest)
+	count, err := db.treeCount()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint64(3000))
+	c.Assert(db.Close(), IsNil)
+}
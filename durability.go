@@ -0,0 +1,125 @@
+package keyvadb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// When an appended value is forced to disk
+type Durability int
+
+const (
+	// Each append is synced before it returns
+	SyncEachWrite Durability = iota
+	// Concurrent appends wait for a shared sync
+	GroupCommit
+	// Appends return once written and are synced periodically
+	Async
+)
+
+var durabilities = map[string]Durability{
+	"sync":  SyncEachWrite,
+	"group": GroupCommit,
+	"async": Async,
+}
+
+func ParseDurability(s string) (Durability, error) {
+	if d, ok := durabilities[s]; ok {
+		return d, nil
+	}
+	return 0, fmt.Errorf("Unknown durability: %s", s)
+}
+
+func (d Durability) String() string {
+	for name, durability := range durabilities {
+		if d == durability {
+			return name
+		}
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// Shares syncs of a file between appenders. One appender leads each sync
+// and the rest wait for it.
+type groupCommit struct {
+	sync.Mutex
+	done *sync.Cond
+	// Forces the file to disk and returns the length now durable
+	sync func() (int64, error)
+	// Time a leader waits for further appends to join it
+	window  time.Duration
+	synced  int64
+	syncing bool
+	// Set by the first failed sync, later syncs cannot be trusted
+	err error
+}
+
+func newGroupCommit(synced int64, window time.Duration, syncFile func() (int64, error)) *groupCommit {
+	g := &groupCommit{
+		sync:   syncFile,
+		window: window,
+		synced: synced,
+	}
+	g.done = sync.NewCond(&g.Mutex)
+	return g
+}
+
+// Must be called with the lock held, which is released during the sync
+func (g *groupCommit) lead(window time.Duration) {
+	g.syncing = true
+	g.Unlock()
+	time.Sleep(window)
+	synced, err := g.sync()
+	g.Lock()
+	g.syncing = false
+	if err != nil && g.err == nil {
+		g.err = err
+	}
+	if synced > g.synced {
+		g.synced = synced
+	}
+	g.done.Broadcast()
+}
+
+// Blocks until the first end bytes of the file are durable
+func (g *groupCommit) wait(end int64) error {
+	g.Lock()
+	defer g.Unlock()
+	for g.synced < end && g.err == nil {
+		if g.syncing {
+			g.done.Wait()
+			continue
+		}
+		g.lead(g.window)
+	}
+	return g.err
+}
+
+// Syncs everything written so far
+func (g *groupCommit) flush() error {
+	g.Lock()
+	defer g.Unlock()
+	for g.syncing {
+		g.done.Wait()
+	}
+	g.lead(0)
+	return g.err
+}
+
+func (g *groupCommit) failed() error {
+	g.Lock()
+	defer g.Unlock()
+	return g.err
+}
+
+// Calls f while no sync is in progress and records synced bytes as durable
+func (g *groupCommit) replace(synced int64, f func()) {
+	g.Lock()
+	defer g.Unlock()
+	for g.syncing {
+		g.done.Wait()
+	}
+	f()
+	g.synced = synced
+}
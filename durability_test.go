@@ -0,0 +1,72 @@
+package keyvadb
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestGroupCommit(c *C) {
+	var length, syncs int64
+	g := newGroupCommit(0, time.Millisecond, func() (int64, error) {
+		atomic.AddInt64(&syncs, 1)
+		return atomic.LoadInt64(&length), nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			end := atomic.AddInt64(&length, 10)
+			c.Check(g.wait(end), IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(g.synced, Equals, int64(1000))
+	c.Assert(syncs < 100, Equals, true, Commentf("%d syncs", syncs))
+
+	failure := errors.New("disk on fire")
+	g = newGroupCommit(0, 0, func() (int64, error) {
+		return 0, failure
+	})
+	c.Assert(g.wait(1), Equals, failure)
+	c.Assert(g.failed(), Equals, failure)
+}
+
+func (s *KeyVaSuite) TestDurability(c *C) {
+	for name, durability := range durabilities {
+		parsed, err := ParseDurability(durability.String())
+		c.Assert(err, IsNil)
+		c.Assert(parsed, Equals, durability)
+		os.Remove(name + ".values")
+		policy := DefaultOptions().Sync
+		policy.Durability = durability
+		values, err := NewFileValueStore(name, false, policy)
+		c.Assert(err, IsNil)
+		gen := NewRandomValueGenerator(10, 40, s.R)
+		kvs, err := gen.Take(100)
+		c.Assert(err, IsNil)
+		var wg sync.WaitGroup
+		for _, kv := range kvs {
+			wg.Add(1)
+			go func(kv KeyValue) {
+				defer wg.Done()
+				appended, err := values.Append(kv.Hash, kv.Value)
+				c.Check(err, IsNil)
+				found, err := values.Get(appended.Id)
+				c.Check(err, IsNil)
+				c.Check(found.Value, DeepEquals, kv.Value)
+			}(kv)
+		}
+		wg.Wait()
+		c.Assert(values.Sync(), IsNil)
+		c.Assert(values.Close(), IsNil)
+		os.Remove(name + ".values")
+	}
+	_, err := ParseDurability("eventually")
+	c.Assert(err, NotNil)
+}
@@ -1,42 +1,67 @@
 package keyvadb
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"math"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/siddontang/go/ioutil2"
 )
 
-func NewFileKeyStore(degree, cacheLevels uint64, filename string) (KeyStore, error) {
+// Number of independently locked shards of the node cache
+const cacheShards = 16
+
+// cacheSize is the number of bytes of nodes to keep in memory. If mapped
+// is true nodes are read from a memory mapping of the file.
+func NewFileKeyStore(degree uint64, cacheSize int64, mapped bool, filename string) (KeyStore, error) {
+	if degree > MaxFileDegree {
+		return nil, fmt.Errorf("degree must be %d or below", MaxFileDegree)
+	}
 	f, err := os.OpenFile(filename+".keys", os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	if fi.Size()%NodeBlockSize != 0 {
 		// TODO: truncate instead?
+		f.Close()
 		return nil, fmt.Errorf("Corrupt key store")
 	}
-	// Sum of consecutive powers of degree
-	cacheSize := int(math.Pow(float64(degree), float64(cacheLevels)) - 1/(float64(degree)-1))
-	return &FileKeyStore{
+	s := &FileKeyStore{
 		f:      f,
 		length: fi.Size(),
-		cache:  NewCache(cacheSize),
-	}, nil
+		cache:  NewCache(cacheSize, cacheShards),
+	}
+	if mapped {
+		if s.mapped, err = newMmap(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 type FileKeyStore struct {
 	f      *os.File
 	length int64
 	cache  *Cache
+	// nil unless reads are from a memory mapping
+	mapped *mmap
 }
 
 func (s *FileKeyStore) Length() int64 {
@@ -58,24 +83,49 @@ func (s *FileKeyStore) Get(id NodeId, degree uint64) (*Node, error) {
 	if node := s.cache.Get(id); node != nil {
 		return node, nil
 	}
+	writes := s.cache.Writes(id)
 	node := NewNode(FirstHash, LastHash, id, degree)
 	debugPrintln("File Key Get:", id)
-	r := io.NewSectionReader(s.f, int64(id), NodeBlockSize)
+	var r io.Reader = io.NewSectionReader(s.f, int64(id), NodeBlockSize)
+	if s.mapped != nil {
+		b, err := s.mapped.slice(int64(id), NodeBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
 	if _, err := node.ReadFrom(r); err != nil {
 		return nil, err
 	}
+	s.cache.AddSince(node, writes)
 	return node, nil
 }
 
+// The cache is updated after the write so that a concurrent Get
+// cannot replace the new node with the one previously on disk
 func (s *FileKeyStore) Set(node *Node) error {
 	debugPrintln("File Key Set:", node.Id)
-	s.cache.Set(node)
 	w := ioutil2.NewSectionWriter(s.f, int64(node.Id), NodeBlockSize)
-	_, err := node.WriteTo(w)
-	return err
+	if _, err := node.WriteTo(w); err != nil {
+		return err
+	}
+	if s.mapped != nil {
+		s.mapped.extend(int64(node.Id) + NodeBlockSize)
+	}
+	s.cache.Set(node)
+	return nil
+}
+
+func (s *FileKeyStore) CacheStats() []CacheStats {
+	return s.cache.Stats()
 }
 
 func (s *FileKeyStore) Close() error {
+	if s.mapped != nil {
+		if err := s.mapped.Close(); err != nil {
+			return err
+		}
+	}
 	if err := s.f.Sync(); err != nil {
 		return err
 	}
@@ -86,24 +136,61 @@ func (s *FileKeyStore) Sync() error {
 	return s.f.Sync()
 }
 
-func NewFileValueStore(filename string) (ValueStore, error) {
-	f, err := os.OpenFile(filename+".values", os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0666)
+// If mapped is true values are read from a memory mapping of the file
+// and share its memory, they remain valid until the store is closed.
+// Append returns once the value is as durable as the policy requires.
+func NewFileValueStore(filename string, mapped bool, policy SyncPolicy) (ValueStore, error) {
+	s, err := openFileValueStore(filename+".values", mapped, policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Durability == Async {
+		s.stopSyncer, s.syncerDone = make(chan struct{}), make(chan struct{})
+		go s.syncer()
+	}
+	return s, nil
+}
+
+func openFileValueStore(path string, mapped bool, policy SyncPolicy) (*FileValueStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return &FileValueStore{
+	s := &FileValueStore{
 		f:      f,
 		length: fi.Size(),
-	}, nil
+		policy: policy,
+	}
+	s.commit = newGroupCommit(s.length, policy.GroupCommitWindow, s.syncFile)
+	if mapped {
+		if s.mapped, err = newMmap(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 type FileValueStore struct {
 	f      *os.File
 	length int64
+	// Serialises appends so that offsets match file positions
+	// and Length never includes a partially written value
+	appending sync.Mutex
+	// nil unless reads are from a memory mapping
+	mapped *mmap
+	// Mappings of files replaced by Compact
+	retired []*mmap
+	policy  SyncPolicy
+	commit  *groupCommit
+	// Used to stop the periodic syncs of Async durability
+	stopSyncer chan struct{}
+	syncerDone chan struct{}
 }
 
 func (s *FileValueStore) Length() int64 {
@@ -115,47 +202,378 @@ func (s *FileValueStore) String() string {
 }
 
 func (s *FileValueStore) Append(key Hash, value []byte) (*KeyValue, error) {
-	size := int64(SizeOfKeyValue(value))
-	length := atomic.AddInt64(&s.length, size)
-	id := ValueId(length - size)
-	kv := NewKeyValue(id, key, value)
-	if _, err := kv.WriteTo(s.f); err != nil {
+	if err := s.commit.failed(); err != nil {
+		return nil, err
+	}
+	s.appending.Lock()
+	kv := NewKeyValue(ValueId(s.Length()), key, value)
+	n, err := kv.WriteTo(s.f)
+	if err == nil && s.policy.Durability == SyncEachWrite {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		s.appending.Unlock()
 		return nil, err
 	}
+	if s.mapped != nil {
+		s.mapped.extend(int64(kv.Id) + n)
+	}
+	atomic.AddInt64(&s.length, n)
+	s.appending.Unlock()
+	if s.policy.Durability == GroupCommit {
+		if err := s.commit.wait(int64(kv.Id) + n); err != nil {
+			return nil, err
+		}
+	}
 	return kv, nil
 }
 
+// Syncs the file and returns the length known to be durable
+func (s *FileValueStore) syncFile() (int64, error) {
+	length := s.Length()
+	return length, s.f.Sync()
+}
+
+func (s *FileValueStore) syncer() {
+	defer close(s.syncerDone)
+	tick := time.NewTicker(s.policy.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			// A failure is returned by the next Append
+			if err := s.commit.flush(); err != nil {
+				return
+			}
+		case <-s.stopSyncer:
+			return
+		}
+	}
+}
+
 func (s *FileValueStore) Get(id ValueId) (*KeyValue, error) {
-	r := io.NewSectionReader(s.f, int64(id), s.Length()-int64(id))
+	if s.mapped != nil {
+		return s.getMapped(id)
+	}
+	remaining := s.Length() - int64(id)
+	r := io.NewSectionReader(s.f, int64(id), remaining)
 	var kv KeyValue
-	if _, err := kv.ReadFrom(r); err != nil {
+	if _, err := kv.readFrom(r, uint64(remaining)); err != nil {
 		return nil, err
 	}
+	kv.Id = id
 	return &kv, nil
 }
 
+// The value refers to the mapped memory rather than a copy
+func (s *FileValueStore) getMapped(id ValueId) (*KeyValue, error) {
+	header, err := s.mapped.slice(int64(id), int64(lengthSize))
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint64(header)
+	if length < SizeOfKeyValue(nil) {
+		return nil, fmt.Errorf("Corrupt value length %d at %d", length, id)
+	}
+	b, err := s.mapped.slice(int64(id), int64(length))
+	if err != nil {
+		return nil, err
+	}
+	kv := &KeyValue{
+		Key:   Key{Id: id},
+		Value: b[lengthSize+HashSize:],
+	}
+	copy(kv.Hash[:], b[lengthSize:])
+	return kv, nil
+}
+
+func (s *FileValueStore) Scan(id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	length := s.Length()
+	if int64(id) > length {
+		return id, fmt.Errorf("Scan offset %d beyond end of value store %d", id, length)
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, int64(id), length-int64(id)))
+	for {
+		kv := &KeyValue{}
+		switch _, err := kv.readFrom(r, uint64(length-int64(id))); {
+		case err == io.EOF:
+			return id, nil
+		case err != nil:
+			return id, err
+		}
+		kv.Id = id
+		if err := f(kv); err != nil {
+			return id, err
+		}
+		id += ValueId(SizeOfKeyValue(kv.Value))
+	}
+}
+
 func (s *FileValueStore) Each(f func(*KeyValue)) error {
-	r := io.NewSectionReader(s.f, 0, s.Length())
+	length := s.Length()
+	r := io.NewSectionReader(s.f, 0, length)
 	var kv KeyValue
-	for _, err := kv.ReadFrom(r); ; _, err = kv.ReadFrom(r) {
+	for n, err := kv.readFrom(r, uint64(length)); ; n, err = kv.readFrom(r, uint64(length)) {
 		switch {
 		case err == io.EOF:
 			return nil
 		case err != nil:
 			return err
 		default:
+			length -= n
 			f(&kv)
 		}
 	}
 }
 
+// The values are written to a temporary file which replaces the store's
+// file once commit succeeds. If the process stops after commit the file
+// is put in place by recoverCompaction.
+func (s *FileValueStore) Compact(f func(ValueStore) error, commit func() error) error {
+	path := s.f.Name()
+	tmpPath := compactedPath(path)
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Syncing is done once f has appended every value
+	compacted, err := openFileValueStore(tmpPath, s.mapped != nil, SyncPolicy{Durability: Async})
+	if err != nil {
+		return err
+	}
+	err = f(compacted)
+	if err == nil {
+		err = compacted.Sync()
+	}
+	if err != nil {
+		compacted.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			// Left for recoverCompaction, which removes it unless commit
+			// got as far as writing the compaction marker
+			compacted.Close()
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if err := syncDir(path); err != nil {
+		return err
+	}
+	previous := s.f
+	s.commit.replace(compacted.Length(), func() {
+		if s.mapped != nil {
+			s.retired = append(s.retired, s.mapped)
+		}
+		s.f, s.mapped = compacted.f, compacted.mapped
+		atomic.StoreInt64(&s.length, compacted.Length())
+	})
+	return previous.Close()
+}
+
 func (s *FileValueStore) Sync() error {
-	return s.f.Sync()
+	return s.commit.flush()
 }
 
 func (s *FileValueStore) Close() error {
+	if s.stopSyncer != nil {
+		close(s.stopSyncer)
+		<-s.syncerDone
+	}
+	for _, m := range append(s.retired, s.mapped) {
+		if m == nil {
+			continue
+		}
+		if err := m.Close(); err != nil {
+			return err
+		}
+	}
 	if err := s.f.Sync(); err != nil {
 		return err
 	}
 	return s.f.Close()
 }
+
+// Path of the file values are compacted into before replacing path
+func compactedPath(path string) string {
+	return path + ".compact"
+}
+
+// Syncs the directory holding path so that renames within it are durable
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// A compaction is committed once its marker is in place. The marker holds
+// the generation the compaction starts followed by every node changed to
+// refer to the compacted values, so that they can be written again if the
+// process stops before the keys are synced.
+func compactionMarker(name string) string {
+	return name + ".compacting"
+}
+
+// Writes the marker for nodes atomically
+func writeCompactionMarker(name string, generation uint64, nodes []*Node) error {
+	path := compactionMarker(name)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = binary.Write(w, binary.BigEndian, generation)
+	for _, node := range nodes {
+		if err != nil {
+			break
+		}
+		if err = binary.Write(w, binary.BigEndian, uint64(node.Id)); err != nil {
+			break
+		}
+		_, err = node.WriteTo(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(path)
+}
+
+func removeCompactionMarker(name string) error {
+	path := compactionMarker(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Finishes a committed compaction of the DB stored under name, or
+// removes the values of one which was not committed
+func recoverCompaction(name string) error {
+	values := name + ".values"
+	marker, err := os.Open(compactionMarker(name))
+	if os.IsNotExist(err) {
+		for _, path := range []string{compactedPath(values), compactionMarker(name) + ".tmp"} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer marker.Close()
+	// The compacted values are already in place if the rename completed
+	switch err := os.Rename(compactedPath(values), values); {
+	case err == nil:
+		if err := syncDir(values); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	keys, err := os.OpenFile(name+".keys", os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+	r := bufio.NewReader(marker)
+	var generation uint64
+	if err := binary.Read(r, binary.BigEndian, &generation); err != nil {
+		return fmt.Errorf("Corrupt compaction marker: %s", err)
+	}
+	block := make([]byte, NodeBlockSize)
+	for {
+		var id uint64
+		switch err := binary.Read(r, binary.BigEndian, &id); {
+		case err == io.EOF:
+			if err := keys.Sync(); err != nil {
+				return err
+			}
+			if err := writeGeneration(name, generation); err != nil {
+				return err
+			}
+			return removeCompactionMarker(name)
+		case err != nil:
+			return fmt.Errorf("Corrupt compaction marker: %s", err)
+		}
+		if _, err := io.ReadFull(r, block); err != nil {
+			return fmt.Errorf("Corrupt compaction marker: %s", err)
+		}
+		if _, err := keys.WriteAt(block, int64(id)); err != nil {
+			return err
+		}
+	}
+}
+
+// The number of compactions of the values of the DB stored under name
+func generationFile(name string) string {
+	return name + ".generation"
+}
+
+func readGeneration(name string) (uint64, error) {
+	b, err := ioutil.ReadFile(generationFile(name))
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	generation, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Corrupt generation in %s: %s", generationFile(name), err)
+	}
+	return generation, nil
+}
+
+func writeGeneration(name string, generation uint64) error {
+	return writeFileAtomic(generationFile(name), []byte(fmt.Sprintf("%d\n", generation)))
+}
+
+// Replaces the file at path with one holding b, so that either the old
+// or the new contents are found after a crash
+func writeFileAtomic(path string, b []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(path)
+}
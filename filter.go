@@ -0,0 +1,270 @@
+package keyvadb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Minimum number of keys a filter is sized for
+const minFilterCapacity = 1 << 16
+
+// Bloom filter over the hashes in a tree. Hashes are uniformly
+// distributed so the bit positions are derived from the hash itself.
+type bloomFilter struct {
+	sync.RWMutex
+	rate float64
+	// Number of hashes the filter is sized for and the number added,
+	// including any already present
+	capacity uint64
+	added    uint64
+	// Number of keys in the tree the filter was last saved with
+	count  uint64
+	hashes uint64
+	bits   []uint64
+}
+
+func newBloomFilter(capacity uint64, rate float64) *bloomFilter {
+	if capacity < minFilterCapacity {
+		capacity = minFilterCapacity
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+	return &bloomFilter{
+		rate:     rate,
+		capacity: capacity,
+		hashes:   uint64(k),
+		bits:     make([]uint64, (uint64(m)+63)/64),
+	}
+}
+
+// Calls f with the bit position of each of the filter's hash functions
+func (f *bloomFilter) each(hash Hash, fn func(bit uint64)) {
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16]) | 1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.hashes; i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (f *bloomFilter) Add(hashes ...Hash) {
+	f.Lock()
+	defer f.Unlock()
+	for _, hash := range hashes {
+		f.each(hash, func(bit uint64) {
+			f.bits[bit/64] |= 1 << (bit % 64)
+		})
+	}
+	f.added += uint64(len(hashes))
+}
+
+// False if hash is certainly not in the tree
+func (f *bloomFilter) Has(hash Hash) bool {
+	f.RLock()
+	defer f.RUnlock()
+	has := true
+	f.each(hash, func(bit uint64) {
+		has = has && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return has
+}
+
+// Replaces the contents of f with those of other
+func (f *bloomFilter) replace(other *bloomFilter) {
+	f.Lock()
+	defer f.Unlock()
+	f.rate, f.capacity, f.added, f.count = other.rate, other.capacity, other.added, other.count
+	f.hashes, f.bits = other.hashes, other.bits
+}
+
+func (f *bloomFilter) full() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.added > f.capacity
+}
+
+func (f *bloomFilter) String() string {
+	f.RLock()
+	defer f.RUnlock()
+	return fmt.Sprintf("Filter: %d/%d keys %d bits %d hashes", f.added, f.capacity, len(f.bits)*64, f.hashes)
+}
+
+// Writes the filter with the number of keys in the tree it covers to a
+// temporary file which then replaces any previous one
+func (f *bloomFilter) save(filename string, count uint64) error {
+	f.RLock()
+	defer f.RUnlock()
+	tmpPath := filename + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	header := []uint64{math.Float64bits(f.rate), f.capacity, f.added, count, f.hashes, uint64(len(f.bits))}
+	for _, v := range [][]uint64{header, f.bits} {
+		if err = binary.Write(w, binary.BigEndian, v); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filename)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filename)
+}
+
+// Number of uint64s before the bits of a saved filter
+const filterHeaderSize = 6
+
+// Returns nil if there is no saved filter
+func loadBloomFilter(filename string) (*bloomFilter, error) {
+	file, err := os.Open(filename)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	header := make([]uint64, filterHeaderSize)
+	if err := binary.Read(r, binary.BigEndian, header); err != nil {
+		return nil, fmt.Errorf("Corrupt filter: %s", err)
+	}
+	rate, words := math.Float64frombits(header[0]), header[5]
+	switch {
+	case uint64(fi.Size())/8 != filterHeaderSize+words || fi.Size()%8 != 0:
+		return nil, fmt.Errorf("Corrupt filter: %d words in %d bytes", words, fi.Size())
+	case words == 0 || header[4] == 0 || !(rate > 0 && rate < 1):
+		return nil, fmt.Errorf("Corrupt filter: %d words %d hashes rate %f", words, header[4], rate)
+	}
+	f := &bloomFilter{
+		rate:     rate,
+		capacity: header[1],
+		added:    header[2],
+		count:    header[3],
+		hashes:   header[4],
+		bits:     make([]uint64, words),
+	}
+	if err := binary.Read(r, binary.BigEndian, f.bits); err != nil {
+		return nil, fmt.Errorf("Corrupt filter: %s", err)
+	}
+	return f, nil
+}
+
+func (db *DB) filterFile() string {
+	return db.name + ".filter"
+}
+
+// Number of keys in the tree
+func (db *DB) treeCount() (uint64, error) {
+	root, err := db.keys.Get(RootNode, db.Degree)
+	if err != nil {
+		return 0, err
+	}
+	return root.Count, nil
+}
+
+// Loads the saved filter, or builds a new one if it is missing, corrupt,
+// was saved with a different rate or is out of date with the tree
+func (db *DB) openFilter() error {
+	if db.FilterFalsePositiveRate == 0 {
+		return nil
+	}
+	count, err := db.treeCount()
+	if err != nil {
+		return err
+	}
+	if !db.InMemory {
+		// The filter only saves reading the tree, so one which cannot be
+		// read is rebuilt
+		f, err := loadBloomFilter(db.filterFile())
+		if err != nil {
+			glog.Warningf("Rebuilding filter %s: %s", db.filterFile(), err)
+		}
+		if f != nil && f.rate == db.FilterFalsePositiveRate && f.count == count {
+			db.filter = f
+			return nil
+		}
+	}
+	return db.rebuildFilter(context.Background(), count)
+}
+
+// Builds a filter with room for the tree to double in size
+func (db *DB) rebuildFilter(ctx context.Context, count uint64) error {
+	f := newBloomFilter(count*2, db.FilterFalsePositiveRate)
+	err := db.tree.WalkContext(ctx, FirstHash, LastHash, func(key *Key) error {
+		f.Add(key.Hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if db.filter == nil {
+		db.filter = f
+		return nil
+	}
+	db.filter.replace(f)
+	return nil
+}
+
+// Adds committed keys to the filter, rebuilding it once it holds more
+// keys than it was sized for
+func (db *DB) updateFilter(ctx context.Context, keys KeySlice) error {
+	if db.filter == nil {
+		return nil
+	}
+	db.filter.Add(keys.Hashes()...)
+	if !db.filter.full() {
+		return nil
+	}
+	count, err := db.treeCount()
+	if err != nil {
+		return err
+	}
+	return db.rebuildFilter(ctx, count)
+}
+
+// Saves the filter of a file DB
+func (db *DB) saveFilter() error {
+	if db.filter == nil || db.InMemory {
+		return nil
+	}
+	count, err := db.treeCount()
+	if err != nil {
+		return err
+	}
+	return db.filter.save(db.filterFile(), count)
+}
+
+// False if hash is certainly not in the tree
+func (db *DB) mayHave(hash Hash) bool {
+	if db.filter == nil || db.filter.Has(hash) {
+		return true
+	}
+	db.Metrics.Add(MetricFilterNegatives, 1)
+	return false
+}
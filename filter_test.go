@@ -0,0 +1,103 @@
+package keyvadb
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestBloomFilter(c *C) {
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(20000)
+	c.Assert(err, IsNil)
+	f := newBloomFilter(10000, 0.01)
+	hashes := kvs.Keys().Hashes()
+	f.Add(hashes[:10000]...)
+	for _, hash := range hashes[:10000] {
+		c.Assert(f.Has(hash), Equals, true)
+	}
+	positives := 0
+	for _, hash := range hashes[10000:] {
+		if f.Has(hash) {
+			positives++
+		}
+	}
+	c.Assert(positives < 200, Equals, true, Commentf("%d false positives", positives))
+	c.Assert(f.full(), Equals, false)
+}
+
+func (s *KeyVaSuite) TestFilteredFileDB(c *C) {
+	for _, ext := range []string{".keys", ".values", ".filter", ".generation", ".hasher"} {
+		os.Remove("filtered" + ext)
+		defer os.Remove("filtered" + ext)
+	}
+	registry := NewRegistry()
+	opts := &Options{BatchSize: 1000, FilterFalsePositiveRate: 0.001, Metrics: registry}
+	db, err := Open("filtered", opts)
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(2000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:1000] {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	check := func(db *DB) {
+		for _, kv := range kvs[:1000] {
+			found, err := db.Get(kv.Hash)
+			c.Assert(err, IsNil)
+			c.Assert(found.Value, DeepEquals, kv.Value)
+		}
+		for _, kv := range kvs[1000:] {
+			_, err := db.Get(kv.Hash)
+			c.Assert(err, Equals, ErrNotFound)
+		}
+	}
+	check(db)
+	c.Assert(registry.Snapshot()[MetricFilterNegatives].(uint64) > 990, Equals, true)
+	c.Assert(db.Close(), IsNil)
+
+	db, err = Open("filtered", opts)
+	c.Assert(err, IsNil)
+	count, err := db.treeCount()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint64(1000))
+	c.Assert(db.filter.count, Equals, count)
+	check(db)
+	c.Assert(db.Close(), IsNil)
+
+	// A filter saved with another rate is rebuilt
+	opts.FilterFalsePositiveRate = 0.01
+	db, err = Open("filtered", opts)
+	c.Assert(err, IsNil)
+	c.Assert(db.filter.rate, Equals, 0.01)
+	check(db)
+	c.Assert(db.Close(), IsNil)
+
+	// A short or corrupt filter is rebuilt
+	fi, err := os.Stat("filtered.filter")
+	c.Assert(err, IsNil)
+	corrupt := []func(){
+		func() { c.Assert(os.Truncate("filtered.filter", fi.Size()-8), IsNil) },
+		func() { c.Assert(os.Truncate("filtered.filter", 20), IsNil) },
+		func() {
+			file, err := os.OpenFile("filtered.filter", os.O_WRONLY, 0)
+			c.Assert(err, IsNil)
+			_, err = file.WriteAt([]byte{0xff}, 5*8)
+			c.Assert(err, IsNil)
+			c.Assert(file.Close(), IsNil)
+		},
+	}
+	for _, f := range corrupt {
+		f()
+		db, err = Open("filtered", opts)
+		c.Assert(err, IsNil)
+		check(db)
+		c.Assert(db.Close(), IsNil)
+		f, err := loadBloomFilter("filtered.filter")
+		c.Assert(err, IsNil)
+		c.Assert(f.count, Equals, count)
+	}
+	_, err = os.Stat("filtered.filter.tmp")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
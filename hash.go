@@ -19,6 +19,21 @@ func (s HashSlice) Sort()              { sort.Sort(s) }
 func (s HashSlice) IsSorted() bool     { return sort.IsSorted(s) }
 func (s HashSlice) String() string     { return dumpWithTitle("Hashes", s, 0) }
 
+// Returns the hashes of a sorted slice which lie strictly between start
+// and end
+func (s HashSlice) GetRange(start, end Hash) HashSlice {
+	first := sort.Search(len(s), func(i int) bool {
+		return start.Less(s[i])
+	})
+	last := sort.Search(len(s), func(i int) bool {
+		return !s[i].Less(end)
+	})
+	if first >= last {
+		return nil
+	}
+	return s[first:last]
+}
+
 func NewHash(s string) (*Hash, error) {
 	b, err := hex.DecodeString(s)
 	switch {
@@ -41,19 +56,6 @@ func MustHash(s string) Hash {
 	return *hash
 }
 
-// Clamps and ensures value is absolute
-func newHash(n *big.Int) Hash {
-	var h Hash
-	n.Abs(n)
-	if n.Cmp(maxBig) >= 0 {
-		h = LastHash
-	} else {
-		b := n.Bytes()
-		copy(h[HashSize-len(b):], b)
-	}
-	return h
-}
-
 func (h Hash) Empty() bool {
 	return h == EmptyKey
 }
@@ -78,9 +80,14 @@ func (h Hash) Big() *big.Int {
 	return big.NewInt(0).SetBytes(h[:])
 }
 
+// Returns the absolute difference of a and b
 func (a Hash) Distance(b Hash) Hash {
-	diff := a.Big()
-	return newHash(diff.Sub(diff, b.Big()))
+	x, y := a.uint256(), b.uint256()
+	if x.cmp(y) < 0 {
+		x, y = y, x
+	}
+	diff, _ := x.sub(y)
+	return diff.hash()
 }
 
 // Returns true if a is closer to b than c
@@ -88,36 +95,97 @@ func (a Hash) Closest(b, c Hash) bool {
 	return a.Distance(b).Compare(a.Distance(c)) <= 0
 }
 
+func (a Hash) Xor(b Hash) Hash {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// Returns h-1 wrapping at zero
+func (h Hash) Previous() Hash {
+	for i := HashSize - 1; i >= 0; i-- {
+		h[i]--
+		if h[i] != 0xFF {
+			break
+		}
+	}
+	return h
+}
+
+// Returns a+b clamped to LastHash
 func (a Hash) Add(b Hash) Hash {
-	sum := a.Big()
-	return newHash(sum.Add(sum, b.Big()))
+	sum, carry := a.uint256().add(b.uint256())
+	if carry != 0 {
+		return LastHash
+	}
+	return sum.hash()
 }
 
+// Returns a divided by the absolute value of n
 func (a Hash) Divide(n int64) Hash {
-	quot := a.Big()
-	return newHash(quot.Div(quot, big.NewInt(n)))
+	d := uint64(n)
+	if n < 0 {
+		d = uint64(-n)
+	}
+	quot, _ := a.uint256().divRem64(d)
+	return quot.hash()
 }
 
 // Returns multiple of stride and distance.
 // Rounds up and down if the extents are matched
 func (a Hash) NearestStride(start, stride, halfStride *big.Int, entries int64) (int, Hash) {
-	quot := a.Big()
-	rem := big.NewInt(0)
-	quot.Sub(quot, start).QuoRem(quot, stride, rem)
-	i := quot.Int64()
-	// fmt.Println(i, a, newHash(rem), newHash(halfStride))
-	switch {
-	case i == 0:
+	return a.nearestStride(newHash(start), newHash(stride), newHash(halfStride), entries)
+}
+
+// Clamps and ensures value is absolute
+func newHash(n *big.Int) Hash {
+	var h Hash
+	abs := new(big.Int).Abs(n)
+	if abs.Cmp(maxBig) >= 0 {
+		h = LastHash
+	} else {
+		b := abs.Bytes()
+		copy(h[HashSize-len(b):], b)
+	}
+	return h
+}
+
+// NearestStride without converting to and from big.Int
+func (a Hash) nearestStride(start, stride, halfStride Hash, entries int64) (int, Hash) {
+	x, s := a.uint256(), start.uint256()
+	d := stride.uint256()
+	var i int64
+	var rem uint256
+	if x.cmp(s) >= 0 {
+		diff, _ := x.sub(s)
+		quot, r := diff.divRem(d)
+		i, rem = int64(quot[0]), r
+		switch {
+		case i == 0:
+			// Shift up
+			i++
+			return int(i), diff.hash().Distance(stride)
+		case i < entries && rem.cmp(halfStride.uint256()) > 0:
+			// Round up
+			i++
+			rem, _ = d.sub(rem)
+		}
+		return int(i), rem.hash()
+	}
+	// Below start the quotient and remainder are negative
+	diff, _ := s.sub(x)
+	quot, r := diff.divRem(d)
+	i, rem = -int64(quot[0]), r
+	if i == 0 {
 		// Shift up
 		i++
-		rem.Sub(a.Big(), stride).Sub(rem, start)
-	case i < entries && rem.Cmp(halfStride) > 0:
-		// Round up
-		i++
-		rem.Sub(stride, rem)
+		var carry uint64
+		if rem, carry = diff.add(d); carry != 0 {
+			return int(i), LastHash
+		}
 	}
-	// fmt.Println(i, newHash(rem))
-	return int(i), newHash(rem)
+	return int(i), rem.hash()
 }
 
 func (a Hash) Stride(b Hash, n int64) Hash {
@@ -1,6 +1,13 @@
 package keyvadb
 
-import . "gopkg.in/check.v1"
+import (
+	"encoding/binary"
+	"io"
+	"math/big"
+	"math/rand"
+
+	. "gopkg.in/check.v1"
+)
 
 func (s *KeyVaSuite) TestHash(c *C) {
 	h0 := MustHash("0000000000000000000000000000000000000000000000000000000000000000")
@@ -13,10 +20,157 @@ func (s *KeyVaSuite) TestHash(c *C) {
 	c.Assert(h4.Stride(h1, 3).Equals(h1), Equals, true)
 	c.Assert(h4.Stride(h2, 2).Equals(h1), Equals, true)
 	c.Assert(h2.Closest(h1, h4), Equals, true)
-	index, distance := h3.NearestStride(h0.Big(), h2.Big(), h2.Divide(2).Big(), 9)
+	index, distance := h3.nearestStride(h0, h2, h2.Divide(2), 9)
 	c.Assert(index, Equals, 1)
 	c.Assert(distance.Equals(h1), Equals, true)
-	index, distance = h3.NearestStride(h0.Big(), h1.Big(), h1.Divide(2).Big(), 9)
+	index, distance = h3.nearestStride(h0, h1, h1.Divide(2), 9)
 	c.Assert(index, Equals, 3)
 	c.Assert(distance.Equals(h0), Equals, true)
 }
+
+// Reference implementations using math/big
+
+// Clamps and ensures value is absolute
+func bigHash(n *big.Int) Hash {
+	var h Hash
+	n.Abs(n)
+	if n.Cmp(maxBig) >= 0 {
+		h = LastHash
+	} else {
+		b := n.Bytes()
+		copy(h[HashSize-len(b):], b)
+	}
+	return h
+}
+
+func bigDistance(a, b Hash) Hash {
+	diff := a.Big()
+	return bigHash(diff.Sub(diff, b.Big()))
+}
+
+func bigAdd(a, b Hash) Hash {
+	sum := a.Big()
+	return bigHash(sum.Add(sum, b.Big()))
+}
+
+func bigDivide(a Hash, n int64) Hash {
+	quot := a.Big()
+	return bigHash(quot.Div(quot, big.NewInt(n)))
+}
+
+func bigNearestStride(a Hash, start, stride, halfStride *big.Int, entries int64) (int, Hash) {
+	quot := a.Big()
+	rem := big.NewInt(0)
+	quot.Sub(quot, start).QuoRem(quot, stride, rem)
+	i := quot.Int64()
+	switch {
+	case i == 0:
+		i++
+		rem.Sub(a.Big(), stride).Sub(rem, start)
+	case i < entries && rem.Cmp(halfStride) > 0:
+		i++
+		rem.Sub(stride, rem)
+	}
+	return int(i), bigHash(rem)
+}
+
+var limbEdges = []uint64{0, 1, 2, 1 << 63, 1<<63 - 1, 1<<64 - 1, 1<<64 - 2}
+
+// Returns a hash made of random and edge case limbs
+func randomHash(r io.Reader, rng *rand.Rand) Hash {
+	var h Hash
+	r.Read(h[:])
+	for i := 0; i < HashSize; i += 8 {
+		switch rng.Intn(4) {
+		case 0:
+			binary.BigEndian.PutUint64(h[i:], limbEdges[rng.Intn(len(limbEdges))])
+		case 1:
+			// Short random limb
+			binary.BigEndian.PutUint64(h[i:], binary.BigEndian.Uint64(h[i:])>>uint(rng.Intn(64)))
+		}
+	}
+	// Skew towards fewer significant limbs
+	for i := 0; i < rng.Intn(4)*8; i++ {
+		h[i] = 0
+	}
+	return h
+}
+
+func (s *KeyVaSuite) TestHashArithmetic(c *C) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		a, b := randomHash(s.R, rng), randomHash(s.R, rng)
+		msg := Commentf("%s %s", a, b)
+		c.Assert(a.Distance(b), Equals, bigDistance(a, b), msg)
+		c.Assert(a.Add(b), Equals, bigAdd(a, b), msg)
+		n := rng.Int63() >> uint(rng.Intn(63))
+		if n == 0 {
+			n = 1
+		}
+		if rng.Intn(4) == 0 {
+			n = -n
+		}
+		c.Assert(a.Divide(n), Equals, bigDivide(a, n), msg)
+		if !b.Empty() {
+			q, r := a.uint256().divRem(b.uint256())
+			bq, br := big.NewInt(0).QuoRem(a.Big(), b.Big(), big.NewInt(0))
+			c.Assert(q.hash(), Equals, bigHash(bq), msg)
+			c.Assert(r.hash(), Equals, bigHash(br), msg)
+		}
+	}
+}
+
+func (s *KeyVaSuite) TestNearestStride(c *C) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		start, a := randomHash(s.R, rng), randomHash(s.R, rng)
+		var stride Hash
+		if rng.Intn(2) == 0 {
+			// As used by a node with entries and a key within it
+			entries := int64(rng.Intn(100) + 1)
+			end := randomHash(s.R, rng)
+			if end.Less(start) {
+				start, end = end, start
+			}
+			stride = start.Stride(end, entries+1)
+			if a.Less(start) || a.Greater(end) {
+				a = start.Add(a.Divide(1 << 62))
+			}
+		} else {
+			// Quotients must fit in an int64 to match
+			stride = randomHash(s.R, rng)
+			stride[0] |= 0x80
+		}
+		if stride.Empty() {
+			continue
+		}
+		entries := int64(rng.Intn(100) + 1)
+		half := stride.Divide(2)
+		index, distance := a.nearestStride(start, stride, half, entries)
+		bigIndex, bigDistance := bigNearestStride(a, start.Big(), stride.Big(), half.Big(), entries)
+		msg := Commentf("%s %s %s %d", a, start, stride, entries)
+		c.Assert(index, Equals, bigIndex, msg)
+		c.Assert(distance, Equals, bigDistance, msg)
+		if i%100 == 0 {
+			index, distance = a.NearestStride(start.Big(), stride.Big(), half.Big(), entries)
+			c.Assert(index, Equals, bigIndex, msg)
+			c.Assert(distance, Equals, bigDistance, msg)
+		}
+	}
+}
+
+func (s *KeyVaSuite) BenchmarkNearestStride(c *C) {
+	start, end := FirstHash, LastHash
+	stride := start.Stride(end, 84)
+	half := stride.Divide(2)
+	var keys HashSlice
+	for i := 0; i < 1000; i++ {
+		var h Hash
+		s.R.Read(h[:])
+		keys = append(keys, h)
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		keys[i%len(keys)].nearestStride(start, stride, half, 83)
+	}
+}
@@ -0,0 +1,20 @@
+package keyvadb
+
+import "time"
+
+// Callbacks made by a DB as it works, any of which may be nil. They are
+// called synchronously, so must be quick and must not call back into
+// the DB.
+type Hooks struct {
+	// Called before a flush writes buffered keys to the tree
+	OnFlushStart func(keys int)
+	// Called once a flush has finished, err is nil if it succeeded
+	OnFlushDone func(keys int, duration time.Duration, err error)
+	// Called with the changed nodes once a journal has written them
+	OnJournalCommit func(deltas []Delta)
+	// Called when a new node is created in the tree
+	OnNodeAlloc func(n *Node)
+	// Called after an Add has waited for a flush or been rejected with
+	// ErrBackpressure, err is the error the Add will return, if any
+	OnThrottle func(waited time.Duration, err error)
+}
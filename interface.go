@@ -6,6 +6,10 @@ import (
 
 var ErrNotFound = errors.New("key not found")
 
+// Returned by Get in a content addressed DB when a value does not hash
+// to its key
+var ErrCorrupt = errors.New("value does not match key")
+
 type KeyStore interface {
 	New(start, end Hash, degree uint64) (*Node, error)
 	Set(*Node) error
@@ -19,6 +23,13 @@ type ValueStore interface {
 	Append(Hash, []byte) (*KeyValue, error)
 	Get(id ValueId) (*KeyValue, error)
 	Each(func(*KeyValue)) error
+	// Calls f for each value from id onwards and returns the id
+	// following the last value visited
+	Scan(id ValueId, f func(*KeyValue) error) (ValueId, error)
+	// Calls f with an empty store and, once that store is durable,
+	// commit. The contents of this store are replaced with it if both
+	// succeed and left unchanged otherwise. commit may be nil.
+	Compact(f func(ValueStore) error, commit func() error) error
 	Close() error
 	Sync() error
 	Length() int64
@@ -26,7 +37,11 @@ type ValueStore interface {
 
 type Journal interface {
 	Swap(current, previous *Node)
+	// The node last swapped in for id since the last Commit, nil if none
+	Pending(id NodeId) *Node
 	Commit() error
+	// Drops swaps made since the last Commit
+	Discard()
 	Len() int
 	String() string
 	Close() error
@@ -0,0 +1,106 @@
+package keyvadb
+
+import "context"
+
+// Number of keys an Iterator reads from the tree at a time
+const iteratorBatch = 256
+
+// Visits the values of flushed keys in a range in order, reading the
+// tree a batch of keys at a time so that it is never locked between
+// calls to Next. Keys flushed during the iteration may not be seen.
+type Iterator struct {
+	db    *DB
+	ctx   context.Context
+	start Hash
+	end   Hash
+	keys  KeySlice
+	// Generation of the value store when keys were read
+	generation uint64
+	done       bool
+	current    *KeyValue
+	err        error
+}
+
+// Iterator returns an Iterator over the flushed keys from start to end
+// inclusive
+func (db *DB) Iterator(start, end Hash) *Iterator {
+	return db.IteratorContext(context.Background(), start, end)
+}
+
+// IteratorContext returns an Iterator which stops with ctx's error once
+// ctx is done
+func (db *DB) IteratorContext(ctx context.Context, start, end Hash) *Iterator {
+	return &Iterator{
+		db:    db,
+		ctx:   ctx,
+		start: start,
+		end:   end,
+		done:  end.Less(start),
+	}
+}
+
+// Next advances to the next value and returns false once there are no
+// more or an error occurred
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.keys) == 0 && !it.done {
+		it.fill()
+	}
+	if len(it.keys) == 0 {
+		it.current = nil
+		return false
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	it.current, it.err = it.value(&key)
+	return it.err == nil
+}
+
+// Reads the next batch of keys, which compaction must not change while
+// they are being read
+func (it *Iterator) fill() {
+	it.db.compactLock.RLock()
+	defer it.db.compactLock.RUnlock()
+	it.generation = it.db.Generation()
+	err := it.db.tree.WalkContext(it.ctx, it.start, it.end, func(key *Key) error {
+		it.keys = append(it.keys, *key)
+		if len(it.keys) == iteratorBatch {
+			return errStopWalk
+		}
+		return nil
+	})
+	switch {
+	case err == errStopWalk:
+		last := it.keys[len(it.keys)-1].Hash
+		it.done = last.Equals(it.end)
+		it.start = last.Add(Hash{HashSize - 1: 1})
+	case err != nil:
+		it.err = err
+	default:
+		it.done = true
+	}
+}
+
+// Compaction changes the ids of values, so a key of a batch read before
+// one is looked up again by its hash
+func (it *Iterator) value(key *Key) (*KeyValue, error) {
+	it.db.compactLock.RLock()
+	if it.db.Generation() != it.generation {
+		it.db.compactLock.RUnlock()
+		return it.db.GetContext(it.ctx, key.Hash)
+	}
+	defer it.db.compactLock.RUnlock()
+	return it.db.keyValue(it.ctx, key)
+}
+
+// KeyValue returns the value Next advanced to
+func (it *Iterator) KeyValue() *KeyValue {
+	return it.current
+}
+
+// Err returns the error which ended the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
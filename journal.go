@@ -7,6 +7,11 @@ type Delta struct {
 	previous *Node
 }
 
+// Id of the changed node
+func (d Delta) Id() NodeId {
+	return d.current.Id
+}
+
 func (d Delta) NewKeys() int {
 	return d.current.Occupancy() - d.previous.Occupancy()
 }
@@ -32,6 +37,10 @@ type SimpleJournal struct {
 	keys   KeyStore
 	values ValueStore
 	deltas []Delta
+	// Current nodes of the deltas by id
+	pending map[NodeId]*Node
+	// Called with the deltas after each successful Commit
+	OnCommit func(deltas []Delta)
 }
 
 func (j *SimpleJournal) Len() int {
@@ -40,6 +49,14 @@ func (j *SimpleJournal) Len() int {
 
 func (j *SimpleJournal) Swap(current, previous *Node) {
 	j.deltas = append(j.deltas, Delta{current, previous})
+	if j.pending == nil {
+		j.pending = make(map[NodeId]*Node)
+	}
+	j.pending[current.Id] = current
+}
+
+func (j *SimpleJournal) Pending(id NodeId) *Node {
+	return j.pending[id]
 }
 
 func (j *SimpleJournal) Commit() error {
@@ -49,10 +66,17 @@ func (j *SimpleJournal) Commit() error {
 			return err
 		}
 	}
-	j.deltas = nil
+	if j.OnCommit != nil {
+		j.OnCommit(j.deltas)
+	}
+	j.deltas, j.pending = nil, nil
 	return nil
 }
 
+func (j *SimpleJournal) Discard() {
+	j.deltas, j.pending = nil, nil
+}
+
 func (j *SimpleJournal) String() string {
 	return dumpWithTitle("Journal", j.deltas, 0)
 }
@@ -0,0 +1,172 @@
+package keyvadb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dchest/blake2b"
+)
+
+// Returned by GetKey when the value found was stored under a different
+// key with the same hash
+var ErrKeyCollision = errors.New("key collision")
+
+// Maps keys of any length to the hashes a DB is keyed by
+type KeyHasher interface {
+	HashKey(key []byte) Hash
+}
+
+// A KeyHasher using the first HashSize bytes of the sum of a new hash
+type HashFunc func() hash.Hash
+
+func (f HashFunc) HashKey(key []byte) Hash {
+	h := f()
+	h.Write(key)
+	var sum Hash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+var (
+	// The first half of SHA-512, as used by RandomValueGenerator
+	SHA512Half KeyHasher = HashFunc(sha512.New)
+	SHA256     KeyHasher = HashFunc(sha256.New)
+	BLAKE2b    KeyHasher = HashFunc(blake2b.New256)
+)
+
+// Identifies a KeyHasher by the hash of a fixed key, "none" without one
+func keyHasherId(hasher KeyHasher) string {
+	if hasher == nil {
+		return "none"
+	}
+	return hasher.HashKey([]byte("keyvadb")).String()
+}
+
+func keyHasherFile(name string) string {
+	return name + ".hasher"
+}
+
+// Records the KeyHasher of an empty DB and checks that of any other, as
+// values are only readable with the KeyHasher they were stored with. A DB
+// with no record was written before they were kept, so without one.
+func checkKeyHasher(name string, hasher KeyHasher, empty bool) error {
+	path := keyHasherFile(name)
+	if empty {
+		return writeFileAtomic(path, []byte(keyHasherId(hasher)+"\n"))
+	}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		b = []byte(keyHasherId(nil))
+		if err := writeFileAtomic(path, b); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	if recorded := strings.TrimSpace(string(b)); recorded != keyHasherId(hasher) {
+		return fmt.Errorf("%s was written with KeyHasher %s not %s", name, recorded, keyHasherId(hasher))
+	}
+	return nil
+}
+
+// With a KeyHasher every value is stored prefixed by the varint length
+// of its original key and the key itself, which is empty for values
+// added by hash
+func encodeKeyed(key, value []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen64+len(key)+len(value))
+	n := binary.PutUvarint(b, uint64(len(key)))
+	n += copy(b[n:], key)
+	n += copy(b[n:], value)
+	return b[:n]
+}
+
+// Returns a copy of kv with the original key split from the value
+func decodeKeyed(kv *KeyValue) (*KeyValue, error) {
+	length, n := binary.Uvarint(kv.Value)
+	if n <= 0 || length > uint64(len(kv.Value)-n) {
+		return nil, fmt.Errorf("Value %d for %s has no key", kv.Id, kv.Hash)
+	}
+	end := n + int(length)
+	decoded := *kv
+	decoded.RawKey = kv.Value[n:end:end]
+	decoded.Value = kv.Value[end:]
+	return &decoded, nil
+}
+
+// Splits the original key from values stored with a KeyHasher
+func (db *DB) decode(kv *KeyValue) (*KeyValue, error) {
+	if db.KeyHasher == nil {
+		return kv, nil
+	}
+	return decodeKeyed(kv)
+}
+
+// PutKey adds value under the hash of key and stores key with it
+func (db *DB) PutKey(key, value []byte) error {
+	return db.PutKeyContext(context.Background(), key, value)
+}
+
+func (db *DB) PutKeyContext(ctx context.Context, key, value []byte) error {
+	if db.KeyHasher == nil {
+		return fmt.Errorf("PutKey requires a KeyHasher")
+	}
+	return db.insert(ctx, db.KeyHasher.HashKey(key), key, value)
+}
+
+// PutKeyIfAbsent is PutKey skipping a key already buffered or in the tree,
+// and returns whether value was added
+func (db *DB) PutKeyIfAbsent(key, value []byte) (bool, error) {
+	return db.PutKeyIfAbsentContext(context.Background(), key, value)
+}
+
+func (db *DB) PutKeyIfAbsentContext(ctx context.Context, key, value []byte) (bool, error) {
+	if db.KeyHasher == nil {
+		return false, fmt.Errorf("PutKeyIfAbsent requires a KeyHasher")
+	}
+	return db.addUnique(ctx, db.KeyHasher.HashKey(key), key, value)
+}
+
+// UpsertKey is PutKey replacing the value of an existing key, see Upsert
+func (db *DB) UpsertKey(key, value []byte) error {
+	return db.UpsertKeyContext(context.Background(), key, value)
+}
+
+func (db *DB) UpsertKeyContext(ctx context.Context, key, value []byte) error {
+	if db.KeyHasher == nil {
+		return fmt.Errorf("UpsertKey requires a KeyHasher")
+	}
+	if key == nil {
+		key = []byte{}
+	}
+	return db.upsert(ctx, db.KeyHasher.HashKey(key), key, value)
+}
+
+// GetKey returns the value stored with PutKey under key, its RawKey is
+// compared with key so a collision returns ErrKeyCollision
+func (db *DB) GetKey(key []byte) (*KeyValue, error) {
+	return db.GetKeyContext(context.Background(), key)
+}
+
+func (db *DB) GetKeyContext(ctx context.Context, key []byte) (*KeyValue, error) {
+	if db.KeyHasher == nil {
+		return nil, fmt.Errorf("GetKey requires a KeyHasher")
+	}
+	kv, err := db.GetContext(ctx, db.KeyHasher.HashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(kv.RawKey, key) {
+		return nil, ErrKeyCollision
+	}
+	return kv, nil
+}
@@ -0,0 +1,138 @@
+package keyvadb
+
+import (
+	"fmt"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+// Always collides
+type constantHasher struct{}
+
+func (constantHasher) HashKey([]byte) Hash {
+	return Hash{1}
+}
+
+func (s *KeyVaSuite) TestKeyHasher(c *C) {
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kv, err := gen.Next()
+	c.Assert(err, IsNil)
+	c.Assert(SHA512Half.HashKey(kv.Value), Equals, kv.Hash)
+	empty, err := NewHash("0E5751C026E543B2E8AB2EB06099DAA1D1E5DF47778F7787FAAB45CDF12FE3A8")
+	c.Assert(err, IsNil)
+	c.Assert(BLAKE2b.HashKey(nil), Equals, *empty)
+
+	for _, hasher := range []KeyHasher{SHA512Half, SHA256, BLAKE2b} {
+		db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, KeyHasher: hasher})
+		c.Assert(err, IsNil)
+		for i := 0; i < 250; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			c.Assert(db.PutKey(key, []byte(fmt.Sprintf("value-%d", i))), IsNil)
+		}
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		c.Assert(db.Flush(), IsNil)
+		found, err := db.GetKey([]byte("key-7"))
+		c.Assert(err, IsNil)
+		c.Assert(string(found.RawKey), Equals, "key-7")
+		c.Assert(string(found.Value), Equals, "value-7")
+		found, err = db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.RawKey, HasLen, 0)
+		c.Assert(found.Value, DeepEquals, kv.Value)
+		count := 0
+		err = db.Range(FirstHash, LastHash, func(kv *KeyValue) {
+			if len(kv.RawKey) > 0 {
+				c.Check(kv.Hash, Equals, hasher.HashKey(kv.RawKey))
+				c.Check(string(kv.Value), Equals, "value-"+string(kv.RawKey[4:]))
+			}
+			count++
+		})
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 251)
+		c.Assert(db.Compact(nil), IsNil)
+		c.Assert(db.Verify(nil), IsNil)
+		found, err = db.GetKey([]byte("key-249"))
+		c.Assert(err, IsNil)
+		c.Assert(string(found.Value), Equals, "value-249")
+	}
+
+	db, err := Open("", &Options{InMemory: true, KeyHasher: constantHasher{}})
+	c.Assert(err, IsNil)
+	c.Assert(db.PutKey([]byte("a"), []byte("apple")), IsNil)
+	_, err = db.GetKey([]byte("b"))
+	c.Assert(err, Equals, ErrKeyCollision)
+	db, err = NewMemoryDB(10, 100, "Distance")
+	c.Assert(err, IsNil)
+	c.Assert(db.PutKey([]byte("a"), nil), NotNil)
+}
+
+func (s *KeyVaSuite) TestKeyHasherRecorded(c *C) {
+	for _, ext := range []string{".keys", ".values", ".hasher"} {
+		os.Remove("hashed" + ext)
+		defer os.Remove("hashed" + ext)
+	}
+	open := func(hasher KeyHasher) (*DB, error) {
+		return Open("hashed", &Options{Degree: 10, BatchSize: 100, KeyHasher: hasher})
+	}
+	db, err := open(SHA256)
+	c.Assert(err, IsNil)
+	c.Assert(db.PutKey([]byte("a"), []byte("apple")), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(db.Close(), IsNil)
+	for _, hasher := range []KeyHasher{BLAKE2b, nil} {
+		_, err = open(hasher)
+		c.Assert(err, ErrorMatches, "hashed was written with KeyHasher .*")
+	}
+	db, err = open(SHA256)
+	c.Assert(err, IsNil)
+	found, err := db.GetKey([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(found.Value), Equals, "apple")
+	c.Assert(db.Close(), IsNil)
+
+	// Without a record the values were stored without a KeyHasher
+	c.Assert(os.Remove("hashed.hasher"), IsNil)
+	_, err = open(SHA256)
+	c.Assert(err, NotNil)
+}
+
+func (s *KeyVaSuite) TestKeyedUpdates(c *C) {
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, KeyHasher: SHA256})
+	c.Assert(err, IsNil)
+	check := func(key, value string) {
+		found, err := db.GetKey([]byte(key))
+		c.Assert(err, IsNil)
+		c.Assert(string(found.Value), Equals, value)
+	}
+	added, err := db.PutKeyIfAbsent([]byte("a"), []byte("apple"))
+	c.Assert(err, IsNil)
+	c.Assert(added, Equals, true)
+	added, err = db.PutKeyIfAbsent([]byte("a"), []byte("avocado"))
+	c.Assert(err, IsNil)
+	c.Assert(added, Equals, false)
+	c.Assert(db.Flush(), IsNil)
+	check("a", "apple")
+
+	// Replacements by hash keep the original key
+	hash := SHA256.HashKey([]byte("a"))
+	c.Assert(db.Upsert(hash, []byte("apricot")), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	check("a", "apricot")
+	swapped, err := db.CompareAndSwap(hash, SHA512Half.HashKey([]byte("apricot")), []byte("almond"))
+	c.Assert(err, IsNil)
+	c.Assert(swapped, Equals, true)
+	c.Assert(db.Flush(), IsNil)
+	check("a", "almond")
+	c.Assert(db.UpsertKey([]byte("a"), []byte("acorn")), IsNil)
+	c.Assert(db.UpsertKey([]byte("b"), []byte("banana")), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	check("a", "acorn")
+	check("b", "banana")
+
+	db, err = NewMemoryDB(10, 100, "Distance")
+	c.Assert(err, IsNil)
+	c.Assert(db.UpsertKey([]byte("a"), nil), NotNil)
+	_, err = db.PutKeyIfAbsent([]byte("a"), nil)
+	c.Assert(err, NotNil)
+}
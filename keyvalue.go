@@ -9,6 +9,8 @@ import (
 type KeyValue struct {
 	Key
 	Value []byte
+	// Key the hash was derived from, if stored with PutKey
+	RawKey []byte
 }
 
 type KeyValueSlice []KeyValue
@@ -38,6 +40,13 @@ func (kv *KeyValue) CloneKey() *Key {
 	}
 }
 
+// Clone copies the value so that it can be modified
+func (kv *KeyValue) Clone() *KeyValue {
+	clone := *kv
+	clone.Value = append([]byte(nil), kv.Value...)
+	return &clone
+}
+
 var lengthSize = binary.Size(uint64(0))
 
 func SizeOfKeyValue(value []byte) uint64 {
@@ -55,17 +64,29 @@ func (kv *KeyValue) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+// Largest encoded KeyValue ReadFrom accepts, so that a corrupt length is
+// not allocated
+const maxKeyValueSize = 1 << 30
+
 func (kv *KeyValue) ReadFrom(r io.Reader) (int64, error) {
+	return kv.readFrom(r, maxKeyValueSize)
+}
+
+// Reads a KeyValue whose encoding is no longer than limit
+func (kv *KeyValue) readFrom(r io.Reader, limit uint64) (int64, error) {
 	var length uint64
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 		return int64(lengthSize), err
 	}
-	n, err := r.Read(kv.Hash[:])
+	if length < SizeOfKeyValue(nil) || length > limit {
+		return int64(lengthSize), fmt.Errorf("Corrupt value length %d", length)
+	}
+	n, err := io.ReadFull(r, kv.Hash[:])
 	if err != nil {
 		return int64(lengthSize + n), err
 	}
 	kv.Value = make([]byte, int(length)-n-lengthSize)
-	n, err = r.Read(kv.Value)
+	n, err = io.ReadFull(r, kv.Value)
 	return int64(lengthSize + HashSize + n), err
 }
 
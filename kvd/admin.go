@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+var adminCommands = map[string]bool{
+	"stats":    true,
+	"summary":  true,
+	"flush":    true,
+	"sync":     true,
+	"verify":   true,
+	"compact":  true,
+	"progress": true,
+}
+
+// Admin commands taking host:port of another kvd
+var peerCommands = map[string]bool{
+	"reconcile": true,
+}
+
+type job struct {
+	name     string
+	done     int64
+	total    int64
+	err      error
+	finished bool
+}
+
+func (j *job) String() string {
+	done, total := atomic.LoadInt64(&j.done), atomic.LoadInt64(&j.total)
+	percent := 0.0
+	if total > 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+	switch {
+	case !j.finished:
+		return fmt.Sprintf("%s: running %6.2f%%", j.name, percent)
+	case j.err != nil:
+		return fmt.Sprintf("%s: failed: %s", j.name, j.err)
+	default:
+		return fmt.Sprintf("%s: complete", j.name)
+	}
+}
+
+// Background admin jobs, at most one of each name at a time
+type jobs struct {
+	m map[string]*job
+	sync.Mutex
+}
+
+var background = &jobs{m: make(map[string]*job)}
+
+func (js *jobs) start(name string, f func(keyvadb.ProgressFunc) error) string {
+	js.Lock()
+	defer js.Unlock()
+	if j, ok := js.m[name]; ok && !j.finished {
+		return j.String()
+	}
+	j := &job{name: name}
+	js.m[name] = j
+	go func() {
+		err := f(func(done, total int64) {
+			atomic.StoreInt64(&j.done, done)
+			atomic.StoreInt64(&j.total, total)
+		})
+		js.Lock()
+		j.err, j.finished = err, true
+		glog.Infoln(j)
+		js.Unlock()
+	}()
+	return fmt.Sprintf("%s: started", name)
+}
+
+func (js *jobs) String() string {
+	js.Lock()
+	defer js.Unlock()
+	s := fmt.Sprintf("Jobs: %d", len(js.m))
+	for _, j := range js.m {
+		s += "\n" + j.String()
+	}
+	return s
+}
+
+// Writes an error unless admin commands are enabled
+func adminEnabled(w *bufio.Writer) bool {
+	if !*admin {
+		writeErr(w, fmt.Errorf("admin commands disabled"))
+	}
+	return *admin
+}
+
+func handleAdmin(db *keyvadb.DB, w *bufio.Writer, command, addr string) {
+	if !adminEnabled(w) {
+		return
+	}
+	glog.V(1).Infof("Admin: %s", command)
+	switch command {
+	case "stats":
+		w.WriteString(db.String() + "\n")
+		for i, stats := range db.CacheStats() {
+			w.WriteString(fmt.Sprintf("Cache Shard %02d: %s Hits: %d Misses: %d\n", i, stats, stats.Hits, stats.Misses))
+		}
+		for i, stats := range db.ValueCacheStats() {
+			w.WriteString(fmt.Sprintf("Value Cache Shard %02d: %s Hits: %d Misses: %d\n", i, stats, stats.Hits, stats.Misses))
+		}
+		if replica != nil {
+			w.WriteString(replica.String() + "\n")
+		}
+	case "summary":
+		sum, err := db.Summary()
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		w.WriteString(sum.String() + "\n")
+	case "flush":
+		if err := db.Flush(); err != nil {
+			writeErr(w, err)
+			return
+		}
+		w.WriteString("flushed\n")
+	case "sync":
+		if err := db.Sync(); err != nil {
+			writeErr(w, err)
+			return
+		}
+		w.WriteString("synced\n")
+	case "verify":
+		w.WriteString(background.start(command, db.Verify) + "\n")
+	case "compact":
+		w.WriteString(background.start(command, db.Compact) + "\n")
+	case "reconcile":
+		w.WriteString(background.start(command, reconcile(db, addr)) + "\n")
+	case "progress":
+		w.WriteString(background.String() + "\n")
+	}
+	w.Flush()
+}
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 
 	"github.com/donovanhide/keyvadb"
@@ -20,9 +21,17 @@ import (
 var port = flag.Int("port", 9000, "port to listen on")
 var degree = flag.Uint64("degree", 84, "degree of tree")
 var batch = flag.Uint64("batch", 10000, "batch size")
-var cache = flag.Uint64("cache", 4, "number of levels of tree to cache (4 is around 2.4GB)")
+var cache = flag.String("cache", "2GB", "memory to use for caching nodes, 0 disables the cache")
+var valueCache = flag.String("valuecache", "256MB", "memory to use for caching values (0 to disable)")
+var mmap = flag.Bool("mmap", false, "read keys and values through memory mappings")
+var durability = flag.String("durability", keyvadb.DefaultOptions().Sync.Durability.String(), "when added values are synced to disk: sync, group or async")
+var filter = flag.Float64("filter", 0, "false positive rate of a bloom filter over keys (0 to disable)")
+var dedup = flag.Bool("dedup", false, "skip adds of keys already in the database")
 var name = flag.String("name", "db", "name of database")
 var balancer = flag.String("balancer", "Distance", "balancer to use")
+var admin = flag.Bool("admin", false, "enable admin commands")
+var metrics = flag.String("metrics", "", "host:port to serve /debug/vars and Prometheus /metrics on")
+var follow = flag.String("follow", "", "host:port of leader with admin commands enabled to replicate from, makes this a read only replica")
 
 func checkErr(err error) {
 	if err != nil {
@@ -39,12 +48,31 @@ func writeErr(w *bufio.Writer, err error) {
 	w.Flush()
 }
 
+var replica *follower
+
 func handleConnection(db *keyvadb.DB, conn net.Conn) {
 	r := bufio.NewReader(conn)
 	w := bufio.NewWriter(conn)
 	for line, err := r.ReadString('\n'); err == nil; line, err = r.ReadString('\n') {
 		parts := strings.Split(line[:len(line)-1], ":")
 		switch {
+		case len(parts) == 1 && adminCommands[parts[0]]:
+			handleAdmin(db, w, parts[0], "")
+		case len(parts) == 3 && peerCommands[parts[0]]:
+			handleAdmin(db, w, parts[0], parts[1]+":"+parts[2])
+		case len(parts) == 3 && parts[0] == "digest":
+			if adminEnabled(w) {
+				writeDigest(db, w, parts[1], parts[2])
+			}
+		case len(parts) == 3 && parts[0] == "hashes":
+			if adminEnabled(w) {
+				writeHashes(db, w, parts[1], parts[2])
+			}
+		case len(parts) == 3 && parts[0] == "replicate":
+			if adminEnabled(w) {
+				replicate(db, w, parts[1], parts[2])
+				return
+			}
 		case len(parts) == 1 && parts[0] == "dump":
 			count := 0
 			err := db.All(func(kv *keyvadb.KeyValue) {
@@ -85,6 +113,8 @@ func handleConnection(db *keyvadb.DB, conn net.Conn) {
 			glog.V(2).Infof("Get: %s", hash)
 			w.WriteString(fmt.Sprintf("%s:%X\n", kv.Hash, kv.Value))
 			w.Flush()
+		case len(parts) == 2 && replica != nil:
+			writeErr(w, fmt.Errorf("read only replica of %s", replica.leader))
 		case len(parts) == 2:
 			hash, err := keyvadb.NewHash(parts[0])
 			if err != nil {
@@ -122,8 +152,38 @@ func accept(ln net.Listener, db *keyvadb.DB, done chan bool) {
 func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	db, err := keyvadb.NewFileDB(*degree, *cache, *batch, *balancer, *name)
+	cacheSize, err := humanize.ParseBytes(*cache)
+	checkErr(err)
+	valueCacheSize, err := humanize.ParseBytes(*valueCache)
 	checkErr(err)
+	nodeCacheSize := int64(cacheSize)
+	if nodeCacheSize == 0 {
+		nodeCacheSize = -1
+	}
+	mode, err := keyvadb.ParseDurability(*durability)
+	checkErr(err)
+	db, err := keyvadb.Open(*name, &keyvadb.Options{
+		Degree:                  *degree,
+		BatchSize:               *batch,
+		Balancer:                *balancer,
+		CacheSize:               nodeCacheSize,
+		ValueCacheSize:          int64(valueCacheSize),
+		Mmap:                    *mmap,
+		Sync:                    keyvadb.SyncPolicy{Durability: mode},
+		Deduplicate:             *dedup,
+		FilterFalsePositiveRate: *filter,
+		Metrics:                 registry,
+	})
+	checkErr(err)
+	if *metrics != "" {
+		go serveMetrics(db, *metrics)
+	}
+	stopReplica, replicaStopped := make(chan bool), make(chan bool)
+	if *follow != "" {
+		replica, err = newFollower(db, *follow, *name)
+		checkErr(err)
+		go replica.run(stopReplica, replicaStopped)
+	}
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	checkErr(err)
 	done := make(chan bool, 1)
@@ -133,5 +193,9 @@ func main() {
 	<-c
 	done <- true
 	checkErr(ln.Close())
+	if replica != nil {
+		close(stopReplica)
+		<-replicaStopped
+	}
 	checkErr(db.Close())
 }
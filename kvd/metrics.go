@@ -0,0 +1,32 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+var registry = keyvadb.NewRegistry()
+
+// Serves the metrics of db as expvars on /debug/vars and in the
+// Prometheus text format on /metrics
+func serveMetrics(db *keyvadb.DB, addr string) {
+	expvar.Publish("keyvadb", expvar.Func(func() interface{} {
+		db.CollectMetrics()
+		return registry.Snapshot()
+	}))
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		db.CollectMetrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := registry.WritePrometheus(w, "keyvadb_"); err != nil {
+			glog.Errorf("Metrics: %s", err)
+		}
+	})
+	glog.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		glog.Errorf("Metrics: %s", err)
+	}
+}
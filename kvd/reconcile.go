@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+func parseRange(start, end string) (*keyvadb.Hash, *keyvadb.Hash, error) {
+	s, err := keyvadb.NewHash(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := keyvadb.NewHash(end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, e, nil
+}
+
+func writeDigest(db *keyvadb.DB, w *bufio.Writer, start, end string) {
+	s, e, err := parseRange(start, end)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	digest, err := db.Digest(*s, *e)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteString(fmt.Sprintf("%d:%s\n", digest.Count, digest.Digest))
+	w.Flush()
+}
+
+func writeHashes(db *keyvadb.DB, w *bufio.Writer, start, end string) {
+	s, e, err := parseRange(start, end)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	count := 0
+	err = db.Hashes(*s, *e, func(hash keyvadb.Hash) error {
+		count++
+		_, err := w.WriteString(hash.String() + "\n")
+		return err
+	})
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteString(fmt.Sprintf("End of hashes: %d\n", count))
+	w.Flush()
+}
+
+// Client for another kvd process
+type peer struct {
+	addr string
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialPeer(addr string) (*peer, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &peer{
+		addr: addr,
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}, nil
+}
+
+func (p *peer) request(format string, a ...interface{}) error {
+	if _, err := fmt.Fprintf(p.w, format+"\n", a...); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+func (p *peer) readLine() (string, error) {
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return line[:len(line)-1], nil
+}
+
+func (p *peer) Digest(start, end keyvadb.Hash) (*keyvadb.RangeDigest, error) {
+	if err := p.request("digest:%s:%s", start, end); err != nil {
+		return nil, err
+	}
+	line, err := p.readLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s: %s", p.addr, line)
+	}
+	count, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p.addr, line)
+	}
+	digest, err := keyvadb.NewHash(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p.addr, line)
+	}
+	return &keyvadb.RangeDigest{
+		Start:  start,
+		End:    end,
+		Digest: *digest,
+		Count:  count,
+	}, nil
+}
+
+func (p *peer) Hashes(start, end keyvadb.Hash, f func(keyvadb.Hash) error) error {
+	if err := p.request("hashes:%s:%s", start, end); err != nil {
+		return err
+	}
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "End of hashes") {
+			return nil
+		}
+		hash, err := keyvadb.NewHash(line)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.addr, line)
+		}
+		if err := f(*hash); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *peer) Get(hash keyvadb.Hash) ([]byte, error) {
+	if err := p.request("%s", hash); err != nil {
+		return nil, err
+	}
+	line, err := p.readLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, ":")
+	if len(parts) != 2 || parts[0] != hash.String() {
+		return nil, fmt.Errorf("%s: %s", p.addr, line)
+	}
+	return hex.DecodeString(parts[1])
+}
+
+// Adds are not acknowledged, the peer's errors are returned by Flush
+func (p *peer) Add(hash keyvadb.Hash, value []byte) error {
+	_, err := fmt.Fprintf(p.w, "%s:%X\n", hash, value)
+	return err
+}
+
+// Flushes the peer's buffered keys, returning the first error written by
+// the peer since the last request which was answered
+func (p *peer) Flush() error {
+	if err := p.request("flush"); err != nil {
+		return err
+	}
+	line, err := p.readLine()
+	switch {
+	case err != nil:
+		return err
+	case line != "flushed":
+		return fmt.Errorf("%s: %s", p.addr, line)
+	}
+	return nil
+}
+
+func (p *peer) Close() error {
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	return p.conn.Close()
+}
+
+// Exchanges the keys missing from either db or the peer at addr and
+// checks that both then have the same digest. The peer must have admin
+// commands enabled. Progress is reported in keys pushed to the peer.
+func reconcile(db *keyvadb.DB, addr string) func(keyvadb.ProgressFunc) error {
+	return func(progress keyvadb.ProgressFunc) error {
+		if replica != nil {
+			return fmt.Errorf("read only replica of %s", replica.leader)
+		}
+		p, err := dialPeer(addr)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		// The peer may be streaming hashes when a difference is found
+		var push, pull keyvadb.HashSlice
+		err = db.Diff(p, func(hash keyvadb.Hash, local bool) error {
+			if local {
+				push = append(push, hash)
+			} else {
+				pull = append(pull, hash)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range pull {
+			value, err := p.Get(hash)
+			if err != nil {
+				return err
+			}
+			if err := db.Add(hash, value); err != nil {
+				return err
+			}
+		}
+		for i, hash := range push {
+			kv, err := db.Get(hash)
+			if err != nil {
+				return err
+			}
+			if err := p.Add(kv.Hash, kv.Value); err != nil {
+				return err
+			}
+			progress(int64(i+1), int64(len(push)))
+		}
+		// Fails if either database changed during reconciliation
+		if err := p.Flush(); err != nil {
+			return err
+		}
+		if err := db.Flush(); err != nil {
+			return err
+		}
+		local, err := db.Digest(keyvadb.FirstHash, keyvadb.LastHash)
+		if err != nil {
+			return err
+		}
+		remote, err := p.Digest(keyvadb.FirstHash, keyvadb.LastHash)
+		if err != nil {
+			return err
+		}
+		if !local.Equals(remote) {
+			return fmt.Errorf("Reconciled with %s but digests differ: %s %s", addr, local, remote)
+		}
+		glog.Infof("Reconciled with %s: pulled %d keys pushed %d keys", addr, len(pull), len(push))
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"path/filepath"
+
+	"github.com/dustin/randbo"
+	. "gopkg.in/check.v1"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+func (s *KvdSuite) TestReconcile(c *C) {
+	dir := c.MkDir()
+	opts := &keyvadb.Options{BatchSize: 1000, CacheSize: 1 << 20, Sync: keyvadb.SyncPolicy{Durability: keyvadb.Async}}
+	local, err := keyvadb.Open(filepath.Join(dir, "local"), opts)
+	c.Assert(err, IsNil)
+	remote, err := keyvadb.Open(filepath.Join(dir, "remote"), opts)
+	c.Assert(err, IsNil)
+	// Digests are only served with admin commands enabled
+	*admin = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	done := make(chan bool, 1)
+	go accept(ln, remote, done)
+	defer func() {
+		done <- true
+		ln.Close()
+	}()
+	gen := keyvadb.NewRandomValueGenerator(10, 40, randbo.NewFrom(rand.NewSource(0)))
+	kvs, err := gen.Take(3000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs[:2000] {
+		c.Assert(local.Add(kv.Hash, kv.Value), IsNil)
+	}
+	for _, kv := range kvs[1000:] {
+		c.Assert(remote.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(local.Flush(), IsNil)
+	c.Assert(remote.Flush(), IsNil)
+
+	pushed := int64(0)
+	err = reconcile(local, ln.Addr().String())(func(done, total int64) {
+		pushed = done
+	})
+	c.Assert(err, IsNil)
+	c.Assert(pushed, Equals, int64(1000))
+	for _, db := range []*keyvadb.DB{local, remote} {
+		for _, kv := range kvs {
+			found, err := db.Get(kv.Hash)
+			c.Assert(err, IsNil)
+			c.Assert(found.Value, DeepEquals, kv.Value)
+		}
+	}
+	c.Assert(local.Close(), IsNil)
+	c.Assert(remote.Close(), IsNil)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+// Limits on the values read from the leader's value store while
+// compaction is blocked
+const (
+	replicationBatch      = 1000
+	replicationBatchBytes = 4 << 20
+)
+
+var errBatchFull = errors.New("batch full")
+
+// Streams every value appended to the leader's value store from offset
+// onwards as offset:hash:value:rawkey:latest lines, where rawkey is the
+// original key of a value stored with a KeyHasher and latest says whether
+// the value is the one its key refers to, each batch followed by a line
+// containing the offset reached which doubles as a heartbeat.
+// Offsets are only meaningful within a generation of the value store, so
+// if the follower's generation is not the leader's, or the leader compacts
+// while streaming, a resync:generation line restarts the stream from the
+// first value. As it reads the whole value store it is an admin command.
+func replicate(db *keyvadb.DB, w *bufio.Writer, generation, offset string) {
+	gen, err := strconv.ParseUint(generation, 10, 64)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	id, err := strconv.ParseUint(offset, 10, 64)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	next := keyvadb.ValueId(id)
+	glog.Infof("Replicating generation %d from offset %d", gen, next)
+	tick := time.NewTicker(time.Second / 10)
+	defer tick.Stop()
+	for {
+		if current := db.Generation(); current != gen {
+			glog.Infof("Resyncing generation %d", current)
+			gen, next = current, 0
+			if _, err := fmt.Fprintf(w, "resync:%d\n", gen); err != nil {
+				return
+			}
+		}
+		batch, resume, err := readBatch(db, gen, next)
+		switch {
+		case err == keyvadb.ErrCompacted:
+			continue
+		case err != nil:
+			writeErr(w, err)
+			return
+		}
+		latest, err := db.Latest(batch)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		// Values read before a compaction are not in the tree after it
+		if db.Generation() != gen {
+			continue
+		}
+		for i, kv := range batch {
+			if _, err := fmt.Fprintf(w, "%d:%s:%X:%X:%t\n", kv.Id, kv.Hash, kv.Value, kv.RawKey, latest[i]); err != nil {
+				return
+			}
+		}
+		next = resume
+		if _, err := fmt.Fprintf(w, "%d\n", next); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			glog.Infof("Replication stopped at offset %d: %s", next, err)
+			return
+		}
+		// Batches are sent back to back until the follower catches up
+		if len(batch) == 0 {
+			<-tick.C
+		}
+	}
+}
+
+// Reads a bounded batch of values from id onwards so that the lock Scan
+// holds against compaction is released before they are written to the
+// follower
+func readBatch(db *keyvadb.DB, gen uint64, id keyvadb.ValueId) ([]*keyvadb.KeyValue, keyvadb.ValueId, error) {
+	var batch []*keyvadb.KeyValue
+	size := 0
+	next, err := db.ScanGeneration(gen, id, func(kv *keyvadb.KeyValue) error {
+		if len(batch) == replicationBatch || size >= replicationBatchBytes {
+			return errBatchFull
+		}
+		batch = append(batch, kv)
+		size += len(kv.Value)
+		return nil
+	})
+	if err != nil && err != errBatchFull {
+		return nil, id, err
+	}
+	return batch, next, nil
+}
+
+type follower struct {
+	db     *keyvadb.DB
+	leader string
+	path   string
+	// Generation of the leader's value store the offsets refer to
+	generation uint64
+	// Offset in the leader's value store up to which values are flushed
+	applied int64
+	// Offset in the leader's value store of the last heartbeat, up to
+	// which values are received but not yet flushed
+	received int64
+	// Offset the leader had sent up to at the last heartbeat, which is
+	// its length once the follower has caught up
+	leaderLength int64
+}
+
+func newFollower(db *keyvadb.DB, leader, name string) (*follower, error) {
+	f := &follower{
+		db:     db,
+		leader: leader,
+		path:   name + ".replication",
+	}
+	b, err := ioutil.ReadFile(f.path)
+	switch {
+	case os.IsNotExist(err):
+		return f, nil
+	case err != nil:
+		return nil, err
+	}
+	// Written as generation:offset, or offset before generations
+	parts := strings.Split(strings.TrimSpace(string(b)), ":")
+	if len(parts) == 2 {
+		if f.generation, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("Corrupt replication generation in %s: %s", f.path, err)
+		}
+	}
+	if f.applied, err = strconv.ParseInt(parts[len(parts)-1], 10, 64); err != nil {
+		return nil, fmt.Errorf("Corrupt replication offset in %s: %s", f.path, err)
+	}
+	f.received = f.applied
+	return f, nil
+}
+
+// Lag in bytes of the leader's value store
+func (f *follower) Lag() int64 {
+	lag := atomic.LoadInt64(&f.leaderLength) - atomic.LoadInt64(&f.applied)
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+func (f *follower) String() string {
+	return fmt.Sprintf("Replication: Leader: %s Generation: %d Applied: %d Leader Length: %d Lag: %d bytes", f.leader, atomic.LoadUint64(&f.generation), atomic.LoadInt64(&f.applied), atomic.LoadInt64(&f.leaderLength), f.Lag())
+}
+
+// Reconnects to the leader until done is closed, then checkpoints
+// and closes stopped
+func (f *follower) run(done, stopped chan bool) {
+	defer close(stopped)
+	for {
+		err := f.follow(done)
+		select {
+		case <-done:
+			if err := f.checkpoint(); err != nil {
+				glog.Errorf("Replication checkpoint failed: %s", err)
+			}
+			return
+		default:
+		}
+		glog.Errorf("Replication from %s failed: %s", f.leader, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *follower) follow(done chan bool) error {
+	conn, err := net.Dial("tcp", f.leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	f.received = atomic.LoadInt64(&f.applied)
+	if _, err := fmt.Fprintf(conn, "replicate:%d:%d\n", f.generation, f.received); err != nil {
+		return err
+	}
+	glog.Infof("Following %s from generation %d offset %d", f.leader, f.generation, f.received)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if err := f.apply(strings.Split(line[:len(line)-1], ":")); err != nil {
+			return err
+		}
+		select {
+		case <-tick.C:
+			if err := f.checkpoint(); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+}
+
+// The leader's latest values are upserted and others added with
+// PutIfAbsent, so that a resync, which resends every value of the leader,
+// only appends those the follower is missing or has a different value for.
+// Values are stored differently with a KeyHasher, so only the leader's
+// heartbeats say where the next value starts.
+func (f *follower) apply(parts []string) error {
+	switch {
+	case len(parts) == 2 && parts[0] == "resync":
+		generation, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Resyncing generation %d from %s", generation, f.leader)
+		atomic.StoreUint64(&f.generation, generation)
+		f.received = 0
+		atomic.StoreInt64(&f.applied, 0)
+		atomic.StoreInt64(&f.leaderLength, 0)
+		return nil
+	case len(parts) == 1:
+		length, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Leader error: %s", parts[0])
+		}
+		if length < f.received {
+			return fmt.Errorf("Out of sequence heartbeat at offset %d expected at least %d", length, f.received)
+		}
+		f.received = length
+		atomic.StoreInt64(&f.leaderLength, length)
+		return nil
+	case len(parts) == 5:
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if offset < f.received {
+			return fmt.Errorf("Out of sequence value at offset %d expected at least %d", offset, f.received)
+		}
+		hash, err := keyvadb.NewHash(parts[1])
+		if err != nil {
+			return err
+		}
+		value, err := hex.DecodeString(parts[2])
+		if err != nil {
+			return err
+		}
+		rawKey, err := hex.DecodeString(parts[3])
+		if err != nil {
+			return err
+		}
+		latest, err := strconv.ParseBool(parts[4])
+		if err != nil {
+			return err
+		}
+		if latest {
+			return f.upsert(*hash, rawKey, value)
+		}
+		return f.put(*hash, rawKey, value)
+	default:
+		return fmt.Errorf("Leader error: %s", strings.Join(parts, ":"))
+	}
+}
+
+// Adds a value by the original key it was stored with on the leader,
+// which must hash to the same key on the follower
+func (f *follower) put(hash keyvadb.Hash, rawKey, value []byte) error {
+	if len(rawKey) == 0 {
+		_, err := f.db.PutIfAbsent(hash, value)
+		return err
+	}
+	if err := f.checkRawKey(hash, rawKey); err != nil {
+		return err
+	}
+	_, err := f.db.PutKeyIfAbsent(rawKey, value)
+	return err
+}
+
+// Replaces the value of a key unless it is already the same
+func (f *follower) upsert(hash keyvadb.Hash, rawKey, value []byte) error {
+	switch current, err := f.db.Get(hash); {
+	case err == nil && bytes.Equal(current.Value, value) && bytes.Equal(current.RawKey, rawKey):
+		return nil
+	case err != nil && err != keyvadb.ErrNotFound:
+		return err
+	}
+	if len(rawKey) == 0 {
+		return f.db.Upsert(hash, value)
+	}
+	if err := f.checkRawKey(hash, rawKey); err != nil {
+		return err
+	}
+	return f.db.UpsertKey(rawKey, value)
+}
+
+func (f *follower) checkRawKey(hash keyvadb.Hash, rawKey []byte) error {
+	switch {
+	case f.db.KeyHasher == nil:
+		return fmt.Errorf("Value %s has an original key but there is no KeyHasher", hash)
+	case f.db.KeyHasher.HashKey(rawKey) != hash:
+		return fmt.Errorf("Value %s has an original key with a different hash", hash)
+	}
+	return nil
+}
+
+// Flushes received values into the tree and persists the generation and
+// offset
+func (f *follower) checkpoint() error {
+	if f.received == atomic.LoadInt64(&f.applied) {
+		return nil
+	}
+	if err := f.db.Flush(); err != nil {
+		return err
+	}
+	// The offset must not get ahead of the values and keys on disk, which
+	// it would without a sync under Async durability
+	if err := f.db.Sync(); err != nil {
+		return err
+	}
+	if err := writeFileSynced(f.path, []byte(fmt.Sprintf("%d:%d\n", atomic.LoadUint64(&f.generation), f.received))); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&f.applied, f.received)
+	glog.V(1).Infoln(f)
+	return nil
+}
+
+// Replaces the file at path with one holding b by way of a synced
+// temporary file, so that either the old or new contents survive a crash
+func writeFileSynced(path string, b []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
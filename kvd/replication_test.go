@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/randbo"
+	. "gopkg.in/check.v1"
+
+	"github.com/donovanhide/keyvadb"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type KvdSuite struct{}
+
+var _ = Suite(&KvdSuite{})
+
+// Offsets are those of file value stores
+func (s *KvdSuite) TestReplication(c *C) {
+	dir := c.MkDir()
+	opts := &keyvadb.Options{BatchSize: 1000, CacheSize: 1 << 20, Sync: keyvadb.SyncPolicy{Durability: keyvadb.Async}}
+	leader, err := keyvadb.Open(filepath.Join(dir, "leader"), opts)
+	c.Assert(err, IsNil)
+	// Values are only streamed with admin commands enabled
+	*admin = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	done := make(chan bool, 1)
+	go accept(ln, leader, done)
+	defer func() {
+		done <- true
+		ln.Close()
+	}()
+	name := filepath.Join(dir, "follower")
+	db, err := keyvadb.Open(name, opts)
+	c.Assert(err, IsNil)
+	f, err := newFollower(db, ln.Addr().String(), name)
+	c.Assert(err, IsNil)
+	stop, stopped := make(chan bool), make(chan bool)
+	go f.run(stop, stopped)
+
+	gen := keyvadb.NewRandomValueGenerator(10, 40, randbo.NewFrom(rand.NewSource(0)))
+	kvs, err := gen.Take(3000)
+	c.Assert(err, IsNil)
+	wait := func(kvs keyvadb.KeyValueSlice) {
+		deadline := time.Now().Add(10 * time.Second)
+		for _, kv := range kvs {
+			for {
+				found, err := db.Get(kv.Hash)
+				if err == nil && bytes.Equal(found.Value, kv.Value) {
+					break
+				}
+				if err != nil {
+					c.Assert(err, Equals, keyvadb.ErrNotFound)
+				}
+				c.Assert(time.Now().Before(deadline), Equals, true, Commentf("%s not replicated", kv.Hash))
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	// More than one batch, with duplicates which compaction removes
+	for _, kv := range kvs[:2000] {
+		c.Assert(leader.Add(kv.Hash, kv.Value), IsNil)
+	}
+	for _, kv := range kvs[:500] {
+		c.Assert(leader.Add(kv.Hash, kv.Value), IsNil)
+	}
+	wait(kvs[:2000])
+
+	// Compaction moves every value so the follower resyncs
+	c.Assert(leader.Compact(nil), IsNil)
+	for _, kv := range kvs[2000:] {
+		c.Assert(leader.Add(kv.Hash, kv.Value), IsNil)
+	}
+	wait(kvs)
+	c.Assert(atomic.LoadUint64(&f.generation), Equals, leader.Generation())
+
+	// Upserts replace the follower's values, as does the last of two
+	// Adds of a new key before a flush
+	updates, err := gen.Take(101)
+	c.Assert(err, IsNil)
+	var changed keyvadb.KeyValueSlice
+	for i, kv := range kvs[:100] {
+		c.Assert(leader.Upsert(kv.Hash, updates[i].Value), IsNil)
+		changed = append(changed, keyvadb.KeyValue{Key: keyvadb.Key{Hash: kv.Hash}, Value: updates[i].Value})
+	}
+	c.Assert(leader.Add(updates[100].Hash, updates[99].Value), IsNil)
+	c.Assert(leader.Add(updates[100].Hash, updates[100].Value), IsNil)
+	// Plain Adds of existing keys change neither
+	c.Assert(leader.Add(kvs[200].Hash, updates[0].Value), IsNil)
+	c.Assert(leader.Flush(), IsNil)
+	wait(append(changed, updates[100]))
+	for _, kv := range append(changed, updates[100], kvs[200]) {
+		found, err := leader.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.Value, DeepEquals, kv.Value)
+	}
+	close(stop)
+	<-stopped
+
+	values := 0
+	_, err = db.Scan(0, func(*keyvadb.KeyValue) error {
+		values++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(values, Equals, 3102)
+	count, err := db.Count(keyvadb.FirstHash, keyvadb.LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint64(3001))
+	found, err := db.Get(kvs[200].Hash)
+	c.Assert(err, IsNil)
+	c.Assert(found.Value, DeepEquals, kvs[200].Value)
+
+	length, err := leader.Scan(0, func(*keyvadb.KeyValue) error { return nil })
+	c.Assert(err, IsNil)
+	restarted, err := newFollower(db, ln.Addr().String(), name)
+	c.Assert(err, IsNil)
+	c.Assert(restarted.generation, Equals, uint64(1))
+	c.Assert(restarted.applied, Equals, int64(length))
+	c.Assert(db.Close(), IsNil)
+	c.Assert(leader.Close(), IsNil)
+}
+
+// Values stored with a KeyHasher are replicated with their original keys
+func (s *KvdSuite) TestKeyedReplication(c *C) {
+	dir := c.MkDir()
+	opts := &keyvadb.Options{BatchSize: 100, CacheSize: 1 << 20, Sync: keyvadb.SyncPolicy{Durability: keyvadb.Async}, KeyHasher: keyvadb.SHA256}
+	leader, err := keyvadb.Open(filepath.Join(dir, "leader"), opts)
+	c.Assert(err, IsNil)
+	*admin = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	done := make(chan bool, 1)
+	go accept(ln, leader, done)
+	defer func() {
+		done <- true
+		ln.Close()
+	}()
+	name := filepath.Join(dir, "follower")
+	db, err := keyvadb.Open(name, opts)
+	c.Assert(err, IsNil)
+	f, err := newFollower(db, ln.Addr().String(), name)
+	c.Assert(err, IsNil)
+	stop, stopped := make(chan bool), make(chan bool)
+	go f.run(stop, stopped)
+
+	for i := 0; i < 500; i++ {
+		c.Assert(leader.PutKey([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))), IsNil)
+	}
+	byHash := keyvadb.MustHash("0101010101010101010101010101010101010101010101010101010101010101")
+	c.Assert(leader.Add(byHash, []byte("by hash")), IsNil)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		found, err := db.Get(byHash)
+		if err == nil {
+			c.Assert(string(found.Value), Equals, "by hash")
+			break
+		}
+		c.Assert(err, Equals, keyvadb.ErrNotFound)
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-stopped
+	for i := 0; i < 500; i++ {
+		found, err := db.GetKey([]byte(fmt.Sprintf("key-%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(string(found.Value), Equals, fmt.Sprintf("value-%d", i))
+	}
+	length, err := leader.Scan(0, func(*keyvadb.KeyValue) error { return nil })
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt64(&f.applied), Equals, int64(length))
+	c.Assert(db.Close(), IsNil)
+	c.Assert(leader.Close(), IsNil)
+}
@@ -1,6 +1,8 @@
 package keyvadb
 
 import (
+	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
@@ -13,6 +15,7 @@ func NewMemoryKeyStore() KeyStore {
 type MemoryKeyStore struct {
 	length int64
 	cache  map[NodeId]*Node
+	sync.RWMutex
 }
 
 func (m *MemoryKeyStore) New(start, end Hash, degree uint64) (*Node, error) {
@@ -24,13 +27,18 @@ func (m *MemoryKeyStore) New(start, end Hash, degree uint64) (*Node, error) {
 
 func (m *MemoryKeyStore) Set(node *Node) error {
 	debugPrintln("Memory Set Key:", node.Id)
+	m.Lock()
 	m.cache[node.Id] = node
+	m.Unlock()
 	return nil
 }
 
 func (m *MemoryKeyStore) Get(id NodeId, degree uint64) (*Node, error) {
 	debugPrintln("Memory Get Key:", id)
-	if node, ok := m.cache[id]; ok {
+	m.RLock()
+	node, ok := m.cache[id]
+	m.RUnlock()
+	if ok {
 		return node.Clone(), nil
 	}
 	return nil, ErrNotFound
@@ -48,6 +56,10 @@ func (m *MemoryKeyStore) Length() int64 {
 	return atomic.LoadInt64(&m.length)
 }
 
+func (m *MemoryKeyStore) String() string {
+	return fmt.Sprintf("Keys: %d nodes", m.Length())
+}
+
 func NewMemoryValueStore() ValueStore {
 	return &MemoryValueStore{}
 }
@@ -55,9 +67,12 @@ func NewMemoryValueStore() ValueStore {
 type MemoryValueStore struct {
 	length int64
 	cache  []*KeyValue
+	sync.RWMutex
 }
 
 func (m *MemoryValueStore) Append(key Hash, value []byte) (*KeyValue, error) {
+	m.Lock()
+	defer m.Unlock()
 	id := ValueId(atomic.AddInt64(&m.length, 1) - 1)
 	kv := NewKeyValue(id, key, value)
 	m.cache = append(m.cache, kv)
@@ -65,19 +80,59 @@ func (m *MemoryValueStore) Append(key Hash, value []byte) (*KeyValue, error) {
 }
 
 func (m *MemoryValueStore) Get(id ValueId) (*KeyValue, error) {
+	m.RLock()
+	defer m.RUnlock()
 	if int(id) >= len(m.cache) {
 		return nil, ErrNotFound
 	}
 	return m.cache[id], nil
 }
 
+// Values are only appended so a snapshot can be visited without the lock
+func (m *MemoryValueStore) snapshot() []*KeyValue {
+	m.RLock()
+	defer m.RUnlock()
+	return m.cache[:len(m.cache):len(m.cache)]
+}
+
+func (m *MemoryValueStore) Scan(id ValueId, f func(*KeyValue) error) (ValueId, error) {
+	cache := m.snapshot()
+	if int(id) > len(cache) {
+		return id, fmt.Errorf("Scan offset %d beyond end of value store %d", id, len(cache))
+	}
+	for _, kv := range cache[id:] {
+		if err := f(kv); err != nil {
+			return id, err
+		}
+		id++
+	}
+	return id, nil
+}
+
 func (m *MemoryValueStore) Each(f func(*KeyValue)) error {
-	for _, v := range m.cache {
+	for _, v := range m.snapshot() {
 		f(v)
 	}
 	return nil
 }
 
+func (m *MemoryValueStore) Compact(f func(ValueStore) error, commit func() error) error {
+	compacted := &MemoryValueStore{}
+	if err := f(compacted); err != nil {
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+	m.Lock()
+	m.cache = compacted.cache
+	atomic.StoreInt64(&m.length, compacted.Length())
+	m.Unlock()
+	return nil
+}
+
 func (m *MemoryValueStore) Close() error {
 	return nil
 }
@@ -89,3 +144,7 @@ func (m *MemoryValueStore) Sync() error {
 func (m *MemoryValueStore) Length() int64 {
 	return atomic.LoadInt64(&m.length)
 }
+
+func (m *MemoryValueStore) String() string {
+	return fmt.Sprintf("Values: %d", m.Length())
+}
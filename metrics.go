@@ -0,0 +1,195 @@
+package keyvadb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receives measurements from a DB. Implementations must be safe for
+// concurrent use. Names ending in _total are counters.
+type Metrics interface {
+	// Adds delta to a counter
+	Add(name string, delta uint64)
+	// Sets a gauge, or a counter maintained elsewhere such as a cache's hits
+	Set(name string, value float64)
+	// Records a value, such as a latency in seconds, in a histogram
+	Observe(name string, value float64)
+}
+
+// Names of the measurements a DB reports
+const (
+	MetricAddSeconds              = "add_seconds"
+	MetricGetSeconds              = "get_seconds"
+	MetricMultiGetSeconds         = "multi_get_seconds"
+	MetricRangeSeconds            = "range_seconds"
+	MetricFlushSeconds            = "flush_seconds"
+	MetricFlushKeys               = "flush_keys"
+	MetricCommitSeconds           = "journal_commit_seconds"
+	MetricAppendedBytes           = "appended_bytes_total"
+	MetricDuplicates              = "duplicates_total"
+	MetricFilterNegatives         = "filter_negatives_total"
+	MetricBufferKeys              = "buffer_keys"
+	MetricPendingBytes            = "pending_bytes"
+	MetricStalls                  = "stalls_total"
+	MetricStallSeconds            = "stall_seconds_total"
+	MetricRejections              = "rejections_total"
+	MetricCacheHits               = "cache_hits_total"
+	MetricCacheMisses             = "cache_misses_total"
+	MetricCacheEvictions          = "cache_evictions_total"
+	MetricCacheResidentBytes      = "cache_resident_bytes"
+	MetricValueCacheHits          = "value_cache_hits_total"
+	MetricValueCacheMisses        = "value_cache_misses_total"
+	MetricValueCacheEvictions     = "value_cache_evictions_total"
+	MetricValueCacheResidentBytes = "value_cache_resident_bytes"
+)
+
+type nopMetrics struct{}
+
+func (nopMetrics) Add(string, uint64)      {}
+func (nopMetrics) Set(string, float64)     {}
+func (nopMetrics) Observe(string, float64) {}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// Upper bounds of histogram buckets, powers of ten from a microsecond
+// to ten million so that both latencies and sizes are covered
+var histogramBuckets = func() []float64 {
+	var buckets []float64
+	for i := -6; i <= 7; i++ {
+		buckets = append(buckets, math.Pow10(i))
+	}
+	return buckets
+}()
+
+type Histogram struct {
+	// Upper bound of each bucket and the number of values in it,
+	// values above the last bound are only included in Count
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{
+		Buckets: histogramBuckets,
+		Counts:  make([]uint64, len(histogramBuckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	if i := sort.SearchFloat64s(h.Buckets, value); i < len(h.Buckets) {
+		h.Counts[i]++
+	}
+	h.Count++
+	h.Sum += value
+}
+
+func (h *Histogram) clone() *Histogram {
+	c := *h
+	c.Counts = append([]uint64(nil), h.Counts...)
+	return &c
+}
+
+// In memory Metrics which can be published with expvar or in the
+// Prometheus text format
+type Registry struct {
+	sync.Mutex
+	counters   map[string]uint64
+	gauges     map[string]float64
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+func (r *Registry) Add(name string, delta uint64) {
+	r.Lock()
+	r.counters[name] += delta
+	r.Unlock()
+}
+
+func (r *Registry) Set(name string, value float64) {
+	r.Lock()
+	r.gauges[name] = value
+	r.Unlock()
+}
+
+func (r *Registry) Observe(name string, value float64) {
+	r.Lock()
+	h, ok := r.histograms[name]
+	if !ok {
+		h = newHistogram()
+		r.histograms[name] = h
+	}
+	h.Observe(value)
+	r.Unlock()
+}
+
+// Snapshot returns a copy of every measurement by name, suitable for
+// publishing with expvar.Func
+func (r *Registry) Snapshot() map[string]interface{} {
+	r.Lock()
+	defer r.Unlock()
+	m := make(map[string]interface{})
+	for name, value := range r.counters {
+		m[name] = value
+	}
+	for name, value := range r.gauges {
+		m[name] = value
+	}
+	for name, h := range r.histograms {
+		m[name] = h.clone()
+	}
+	return m
+}
+
+// WritePrometheus writes every measurement in the Prometheus text
+// exposition format with each name prefixed by prefix
+func (r *Registry) WritePrometheus(w io.Writer, prefix string) error {
+	snapshot := r.Snapshot()
+	var names []string
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		full := prefix + name
+		switch value := snapshot[name].(type) {
+		case uint64:
+			lines = append(lines, "# TYPE "+full+" counter", fmt.Sprintf("%s %d", full, value))
+		case float64:
+			kind := "gauge"
+			if strings.HasSuffix(name, "_total") {
+				kind = "counter"
+			}
+			lines = append(lines, "# TYPE "+full+" "+kind, fmt.Sprintf("%s %g", full, value))
+		case *Histogram:
+			lines = append(lines, "# TYPE "+full+" histogram")
+			var cumulative uint64
+			for i, bound := range value.Buckets {
+				cumulative += value.Counts[i]
+				lines = append(lines, fmt.Sprintf("%s_bucket{le=\"%g\"} %d", full, bound, cumulative))
+			}
+			lines = append(lines,
+				fmt.Sprintf("%s_bucket{le=\"+Inf\"} %d", full, value.Count),
+				fmt.Sprintf("%s_sum %g", full, value.Sum),
+				fmt.Sprintf("%s_count %d", full, value.Count))
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,53 @@
+package keyvadb
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestMetrics(c *C) {
+	registry := NewRegistry()
+	db, err := Open("", &Options{
+		InMemory:  true,
+		Degree:    10,
+		BatchSize: 100000,
+		Metrics:   registry,
+	})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(100)
+	c.Assert(err, IsNil)
+	var appended uint64
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		appended += SizeOfKeyValue(kv.Value)
+	}
+	c.Assert(db.Flush(), IsNil)
+	for _, kv := range kvs {
+		_, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+	}
+	db.CollectMetrics()
+	snapshot := registry.Snapshot()
+	c.Assert(snapshot[MetricAppendedBytes], Equals, appended)
+	c.Assert(snapshot[MetricAddSeconds].(*Histogram).Count, Equals, uint64(100))
+	c.Assert(snapshot[MetricGetSeconds].(*Histogram).Count, Equals, uint64(100))
+	c.Assert(snapshot[MetricFlushKeys].(*Histogram).Sum, Equals, float64(100))
+	c.Assert(snapshot[MetricBufferKeys], Equals, float64(0))
+
+	var b bytes.Buffer
+	c.Assert(registry.WritePrometheus(&b, "keyvadb_"), IsNil)
+	text := b.String()
+	for _, line := range []string{
+		"# TYPE keyvadb_appended_bytes_total counter",
+		"# TYPE keyvadb_stalls_total counter",
+		"# TYPE keyvadb_buffer_keys gauge",
+		"keyvadb_flush_keys_bucket{le=\"100\"} 1",
+		"keyvadb_flush_keys_bucket{le=\"+Inf\"} 1",
+		"keyvadb_get_seconds_count 100",
+	} {
+		c.Assert(strings.Contains(text, line+"\n"), Equals, true, Commentf("%s missing from:\n%s", line, text))
+	}
+}
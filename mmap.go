@@ -0,0 +1,101 @@
+package keyvadb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Smallest mapping made, address space is reserved in doubling steps
+// beyond the end of the file so that remapping is rare
+const minMapping = 64 << 20
+
+// Read only shared mapping of a file which grows as the file is written.
+// Superseded mappings are only unmapped by Close so that slices handed
+// out remain valid until then.
+type mmap struct {
+	f *os.File
+	sync.RWMutex
+	data []byte
+	// Bytes of the file known to be written
+	written int64
+	retired [][]byte
+}
+
+func newMmap(f *os.File) (*mmap, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mmap{
+		f:       f,
+		written: fi.Size(),
+	}
+	if err := m.remap(m.written); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Must be called with the lock held
+func (m *mmap) remap(size int64) error {
+	length := int64(minMapping)
+	for length < size {
+		length *= 2
+	}
+	data, err := mapFile(m.f, length)
+	if err != nil {
+		return err
+	}
+	if m.data != nil {
+		m.retired = append(m.retired, m.data)
+	}
+	m.data = data
+	return nil
+}
+
+// Records that the file has been written up to end
+func (m *mmap) extend(end int64) {
+	m.Lock()
+	if end > m.written {
+		m.written = end
+	}
+	m.Unlock()
+}
+
+// Returns the mapped bytes from off to off+n without copying
+func (m *mmap) slice(off, n int64) ([]byte, error) {
+	m.RLock()
+	if off < 0 || n < 0 || off+n > m.written {
+		written := m.written
+		m.RUnlock()
+		return nil, fmt.Errorf("Read of %d bytes at %d beyond end of %s at %d", n, off, m.f.Name(), written)
+	}
+	if off+n <= int64(len(m.data)) {
+		b := m.data[off : off+n : off+n]
+		m.RUnlock()
+		return b, nil
+	}
+	m.RUnlock()
+	m.Lock()
+	defer m.Unlock()
+	if off+n > int64(len(m.data)) {
+		if err := m.remap(m.written); err != nil {
+			return nil, err
+		}
+	}
+	return m.data[off : off+n : off+n], nil
+}
+
+func (m *mmap) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	var first error
+	for _, data := range append(m.retired, m.data) {
+		if err := unmapFile(data); err != nil && first == nil {
+			first = err
+		}
+	}
+	m.data, m.retired = nil, nil
+	return first
+}
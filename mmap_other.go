@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package keyvadb
+
+import (
+	"fmt"
+	"os"
+)
+
+func mapFile(f *os.File, length int64) ([]byte, error) {
+	return nil, fmt.Errorf("mmap is not supported on this platform")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
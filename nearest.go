@@ -0,0 +1,138 @@
+package keyvadb
+
+import (
+	"container/heap"
+	"context"
+	"math/bits"
+)
+
+// A measure of distance between hashes
+type metric struct {
+	distance func(a, b Hash) Hash
+	// A lower bound of the distance from target to any hash from start
+	// to end inclusive
+	bound func(target, start, end Hash) Hash
+}
+
+var numericMetric = metric{
+	distance: Hash.Distance,
+	bound: func(target, start, end Hash) Hash {
+		switch {
+		case target.Less(start):
+			return start.Distance(target)
+		case target.Greater(end):
+			return end.Distance(target)
+		default:
+			return EmptyKey
+		}
+	},
+}
+
+var xorMetric = metric{
+	distance: Hash.Xor,
+	// Hashes in the range share the prefix of start and end, so their
+	// distance is at least that of the prefix
+	bound: func(target, start, end Hash) Hash {
+		bound := start.Xor(target)
+		for i := range start {
+			if diff := start[i] ^ end[i]; diff != 0 {
+				bound[i] &= byte(0xFF) << uint(bits.Len8(diff))
+				for j := i + 1; j < len(bound); j++ {
+					bound[j] = 0
+				}
+				break
+			}
+		}
+		return bound
+	},
+}
+
+// A key at its distance, or a node at the least distance of any of its keys
+type candidate struct {
+	distance Hash
+	key      *Key
+	id       NodeId
+}
+
+type candidates []candidate
+
+func (c candidates) Len() int            { return len(c) }
+func (c candidates) Less(i, j int) bool  { return c[i].distance.Less(c[j].distance) }
+func (c candidates) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *candidates) Push(x interface{}) { *c = append(*c, x.(candidate)) }
+func (c *candidates) Pop() interface{} {
+	old := *c
+	last := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return last
+}
+
+// Returns the k keys nearest to target in order of distance. Nodes are
+// read in order of the least possible distance of their keys, so only
+// those which could hold one of the k nearest are read.
+func (t *Tree) nearest(ctx context.Context, target Hash, k int, m metric) (KeySlice, error) {
+	var found KeySlice
+	queue := &candidates{{id: RootNode}}
+	for queue.Len() > 0 && len(found) < k {
+		next := heap.Pop(queue).(candidate)
+		if next.key != nil {
+			found = append(found, *next.key)
+			continue
+		}
+		n, err := t.node(ctx, next.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range n.Keys {
+			if !key.Empty() && !key.Id.Synthetic() {
+				heap.Push(queue, candidate{distance: m.distance(key.Hash, target), key: key.Clone()})
+			}
+		}
+		for i, cid := range n.Children {
+			if !cid.Empty() {
+				start, end := n.GetChildRange(i)
+				heap.Push(queue, candidate{distance: m.bound(target, start, end), id: cid})
+			}
+		}
+	}
+	return found, nil
+}
+
+// Nearest returns the k keys numerically nearest to target, nearest first
+func (t *Tree) Nearest(target Hash, k int) (KeySlice, error) {
+	return t.NearestContext(context.Background(), target, k)
+}
+
+func (t *Tree) NearestContext(ctx context.Context, target Hash, k int) (KeySlice, error) {
+	return t.nearest(ctx, target, k, numericMetric)
+}
+
+// NearestXOR returns the k keys nearest to target by the XOR metric used
+// by Kademlia, nearest first
+func (t *Tree) NearestXOR(target Hash, k int) (KeySlice, error) {
+	return t.NearestXORContext(context.Background(), target, k)
+}
+
+func (t *Tree) NearestXORContext(ctx context.Context, target Hash, k int) (KeySlice, error) {
+	return t.nearest(ctx, target, k, xorMetric)
+}
+
+// Nearest returns the k flushed keys numerically nearest to target,
+// nearest first
+func (db *DB) Nearest(target Hash, k int) (KeySlice, error) {
+	return db.NearestContext(context.Background(), target, k)
+}
+
+func (db *DB) NearestContext(ctx context.Context, target Hash, k int) (KeySlice, error) {
+	return db.tree.NearestContext(ctx, target, k)
+}
+
+// NearestXOR returns the k flushed keys nearest to target by XOR distance,
+// nearest first
+func (db *DB) NearestXOR(target Hash, k int) (KeySlice, error) {
+	return db.NearestXORContext(context.Background(), target, k)
+}
+
+func (db *DB) NearestXORContext(ctx context.Context, target Hash, k int) (KeySlice, error) {
+	return db.tree.NearestXORContext(ctx, target, k)
+}
@@ -23,7 +23,13 @@ type Node struct {
 	End      Hash
 	Keys     KeySlice
 	Children []NodeId
-	Dirty    bool
+	// XOR of the hashes of all keys in this node and its descendants
+	Digest Hash
+	// Number of keys in this node and its descendants
+	Count uint64
+	Dirty bool
+	// Format of the block the node was read from
+	format uint8
 }
 
 func NewNode(start, end Hash, id NodeId, degree uint64) *Node {
@@ -46,10 +52,12 @@ func (n *Node) CloneIfClean() *Node {
 
 func (n *Node) Clone() *Node {
 	c := &Node{
-		Id:    n.Id,
-		Start: n.Start,
-		End:   n.End,
-		Keys:  n.Keys.Clone(),
+		Id:     n.Id,
+		Start:  n.Start,
+		End:    n.End,
+		Keys:   n.Keys.Clone(),
+		Digest: n.Digest,
+		Count:  n.Count,
 	}
 	c.Children = make([]NodeId, len(n.Children))
 	copy(c.Children, n.Children)
@@ -113,6 +121,20 @@ func (n *Node) Occupancy() int {
 	return count
 }
 
+// Returns the XOR of the hashes of the real keys held by
+// this node alone and the number of those keys
+func (n *Node) OwnDigest() (Hash, uint64) {
+	var digest Hash
+	var count uint64
+	for _, key := range n.Keys {
+		if !key.Empty() && !key.Id.Synthetic() {
+			digest = digest.Xor(key.Hash)
+			count++
+		}
+	}
+	return digest, count
+}
+
 func (n *Node) NonEmptyKeys() KeySlice {
 	var keys KeySlice
 	for _, key := range n.Keys {
@@ -139,6 +161,11 @@ func (n *Node) Distance() Hash {
 	return n.Start.Distance(n.End)
 }
 
+// Approximate bytes of memory used by the node
+func (n *Node) Size() int64 {
+	return int64(nodeHeaderSize + len(n.Keys)*keySize + len(n.Children)*8)
+}
+
 func (n *Node) MaxEntries() int {
 	return len(n.Keys)
 }
@@ -178,8 +205,8 @@ func (n *Node) String() string {
 	}
 	format := "Id:\t\t%d\nDirty:\t\t%t\nWell Formed:\t%t\nOccupancy:\t%d\n"
 	format += "Children:\t%+v\nStart:\t\t%s\nEnd:\t\t%s\nDistance:\t%s\n"
-	format += "Stride:\t\t%s\n--------\n%s\n--------"
-	return fmt.Sprintf(format, n.Id, n.Dirty, n.SanityCheck(), n.Occupancy(), n.Children, n.Start, n.End, n.Distance(), n.Stride(), strings.Join(items, "\n"))
+	format += "Stride:\t\t%s\nDigest:\t\t%s\nCount:\t\t%d\n--------\n%s\n--------"
+	return fmt.Sprintf(format, n.Id, n.Dirty, n.SanityCheck(), n.Occupancy(), n.Children, n.Start, n.End, n.Distance(), n.Stride(), n.Digest, n.Count, strings.Join(items, "\n"))
 }
 
 func (n *Node) Len() int           { return len(n.Keys) }
@@ -206,6 +233,8 @@ func (node *Node) WriteTo(w io.Writer) (int64, error) {
 		binary.BigEndian.PutUint64(b[n:], uint64(child))
 		n += 8
 	}
+	n += copy(b[n:], node.Digest[:])
+	binary.BigEndian.PutUint64(b[n:], node.Count&countMask|nodeFormat<<56)
 	n, err := w.Write(b)
 	return int64(n), err
 }
@@ -226,5 +255,8 @@ func (node *Node) ReadFrom(r io.Reader) (int64, error) {
 		node.Children[i] = NodeId(binary.BigEndian.Uint64(b[n:]))
 		n += 8
 	}
+	n += copy(node.Digest[:], b[n:])
+	count := binary.BigEndian.Uint64(b[n:])
+	node.Count, node.format = count&countMask, uint8(count>>56)
 	return NodeBlockSize, nil
 }
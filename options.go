@@ -0,0 +1,149 @@
+package keyvadb
+
+import (
+	"fmt"
+	"time"
+)
+
+// When and how appended values are forced to disk
+type SyncPolicy struct {
+	Durability Durability
+	// Time a group commit waits for further appends to join it
+	GroupCommitWindow time.Duration
+	// Interval between syncs with Async durability
+	Interval time.Duration
+}
+
+// Settings of a DB. Zero values are replaced by those of DefaultOptions.
+type Options struct {
+	// Maximum number of keys in a node, at most MaxFileDegree unless InMemory
+	Degree uint64
+	// Number of buffered keys which triggers a flush to the tree
+	BatchSize uint64
+	// Name of one of Balancers
+	Balancer string
+	// Keeps keys and values in memory only, the path is ignored
+	InMemory bool
+	// Bytes of nodes to keep in memory, disabled if negative
+	CacheSize int64
+	// Bytes of values to keep in memory, disabled if zero
+	ValueCacheSize int64
+	// Read the key and value files through memory mappings
+	Mmap bool
+	Sync SyncPolicy
+	// Interval between checks of whether the buffer holds a batch
+	FlushInterval time.Duration
+	// Adds wait for a flush once this many keys or bytes of values are
+	// pending, MaxBufferedKeys defaults to three batches
+	MaxBufferedKeys  uint64
+	MaxBufferedBytes int64
+	// Adds fail with ErrBackpressure rather than wait
+	FailFast bool
+	// Receives measurements of the DB, see CollectMetrics
+	Metrics Metrics
+	// Adds of keys already buffered or in the tree are skipped rather
+	// than appended to the value store, see AddUnique
+	Deduplicate bool
+	// Enables Put, which keys each value by the SHA-512 half of it, makes
+	// other writes fail with ErrCorrupt unless their keys are that hash and
+	// makes Get check values against their keys
+	ContentAddressed bool
+	// Enables PutKey and GetKey, values are then stored with their
+	// original keys so must be the same every time the DB is opened
+	KeyHasher KeyHasher
+	// Keeps a bloom filter over the keys in the tree with this false
+	// positive rate, so that most Gets of missing keys do not read any
+	// nodes. Saved next to the keys on Close. Disabled if zero.
+	FilterFalsePositiveRate float64
+	// Callbacks for flushes, commits, node allocation and throttling
+	Hooks Hooks
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Degree:    MaxFileDegree,
+		BatchSize: 10000,
+		Balancer:  "Distance",
+		CacheSize: 256 << 20,
+		Sync: SyncPolicy{
+			Durability:        SyncEachWrite,
+			GroupCommitWindow: time.Millisecond,
+			Interval:          time.Second,
+		},
+		FlushInterval:    time.Second / 10,
+		MaxBufferedKeys:  30000,
+		MaxBufferedBytes: 256 << 20,
+	}
+}
+
+// Returns a copy with zero values replaced by defaults
+func (o *Options) withDefaults() *Options {
+	defaults := DefaultOptions()
+	if o == nil {
+		o = defaults
+	}
+	opts := *o
+	if opts.Degree == 0 {
+		opts.Degree = defaults.Degree
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.Balancer == "" {
+		opts.Balancer = defaults.Balancer
+	}
+	switch {
+	case opts.CacheSize == 0:
+		opts.CacheSize = defaults.CacheSize
+	case opts.CacheSize < 0:
+		opts.CacheSize = 0
+	}
+	if opts.Sync.GroupCommitWindow == 0 {
+		opts.Sync.GroupCommitWindow = defaults.Sync.GroupCommitWindow
+	}
+	if opts.Sync.Interval == 0 {
+		opts.Sync.Interval = defaults.Sync.Interval
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+	if opts.MaxBufferedKeys == 0 {
+		opts.MaxBufferedKeys = opts.BatchSize * 3
+	}
+	if opts.MaxBufferedBytes == 0 {
+		opts.MaxBufferedBytes = defaults.MaxBufferedBytes
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = nopMetrics{}
+	}
+	return &opts
+}
+
+func (o *Options) Validate() error {
+	switch {
+	case o.Degree < 2:
+		return fmt.Errorf("Degree must be 2 or above")
+	case !o.InMemory && o.Degree > MaxFileDegree:
+		return fmt.Errorf("Degree must be %d or below", MaxFileDegree)
+	case o.BatchSize == 0:
+		return fmt.Errorf("BatchSize must be 1 or above")
+	case o.CacheSize < 0 || o.ValueCacheSize < 0:
+		return fmt.Errorf("Cache sizes must not be negative")
+	case o.Sync.Durability < SyncEachWrite || o.Sync.Durability > Async:
+		return fmt.Errorf("Unknown durability: %s", o.Sync.Durability)
+	case o.Sync.GroupCommitWindow < 0 || o.Sync.Interval <= 0:
+		return fmt.Errorf("Sync intervals must be positive")
+	case o.FlushInterval <= 0:
+		return fmt.Errorf("FlushInterval must be positive")
+	case o.MaxBufferedKeys < o.BatchSize:
+		return fmt.Errorf("MaxBufferedKeys must be at least BatchSize")
+	case o.MaxBufferedBytes <= 0:
+		return fmt.Errorf("MaxBufferedBytes must be positive")
+	case o.FilterFalsePositiveRate < 0 || o.FilterFalsePositiveRate >= 1:
+		return fmt.Errorf("FilterFalsePositiveRate must be at least 0 and below 1")
+	case o.ContentAddressed && o.KeyHasher != nil:
+		return fmt.Errorf("ContentAddressed and KeyHasher cannot be combined")
+	}
+	_, err := newBalancer(o.Balancer)
+	return err
+}
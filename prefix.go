@@ -0,0 +1,75 @@
+package keyvadb
+
+import (
+	"context"
+	"fmt"
+)
+
+// PrefixRange returns the first and last hashes starting with the first
+// bits of prefix. The empty hash is never stored, so a prefix of zeros
+// starts at FirstHash.
+func PrefixRange(prefix []byte, bits int) (Hash, Hash, error) {
+	if bits < 0 || bits > len(prefix)*8 || bits > HashSize*8 {
+		return EmptyKey, EmptyKey, fmt.Errorf("Prefix of %d bits from %d bytes", bits, len(prefix))
+	}
+	start, end := EmptyKey, LastHash
+	whole := bits / 8
+	copy(start[:whole], prefix)
+	copy(end[:whole], prefix)
+	if partial := uint(bits % 8); partial > 0 {
+		mask := byte(0xFF) << (8 - partial)
+		start[whole] = prefix[whole] & mask
+		end[whole] = prefix[whole] | ^mask
+	}
+	if start.Empty() {
+		start = FirstHash
+	}
+	return start, end, nil
+}
+
+// Prefix walks the keys whose hashes start with the first bits of prefix
+func (t *Tree) Prefix(prefix []byte, bits int, f WalkFunc) error {
+	return t.PrefixContext(context.Background(), prefix, bits, f)
+}
+
+func (t *Tree) PrefixContext(ctx context.Context, prefix []byte, bits int, f WalkFunc) error {
+	start, end, err := PrefixRange(prefix, bits)
+	if err != nil {
+		return err
+	}
+	return t.WalkContext(ctx, start, end, f)
+}
+
+// Prefix visits the values of the flushed keys whose hashes start with
+// prefix in order
+func (db *DB) Prefix(prefix []byte, f KeyValueFunc) error {
+	return db.PrefixBits(prefix, len(prefix)*8, f)
+}
+
+// PrefixBits is Prefix for a prefix of the first bits of prefix, which
+// need not be a whole number of bytes
+func (db *DB) PrefixBits(prefix []byte, bits int, f KeyValueFunc) error {
+	return db.PrefixBitsContext(context.Background(), prefix, bits, f)
+}
+
+func (db *DB) PrefixBitsContext(ctx context.Context, prefix []byte, bits int, f KeyValueFunc) error {
+	start, end, err := PrefixRange(prefix, bits)
+	if err != nil {
+		return err
+	}
+	return db.RangeContext(ctx, start, end, f)
+}
+
+// PrefixIterator returns an Iterator over the flushed keys whose hashes
+// start with the first bits of prefix
+func (db *DB) PrefixIterator(prefix []byte, bits int) (*Iterator, error) {
+	return db.PrefixIteratorContext(context.Background(), prefix, bits)
+}
+
+func (db *DB) PrefixIteratorContext(ctx context.Context, prefix []byte, bits int) (*Iterator, error) {
+	start, end, err := PrefixRange(prefix, bits)
+	if err != nil {
+		return nil, err
+	}
+	return db.IteratorContext(ctx, start, end), nil
+}
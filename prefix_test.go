@@ -0,0 +1,127 @@
+package keyvadb
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestPrefixRange(c *C) {
+	for _, t := range []struct {
+		prefix     []byte
+		bits       int
+		start, end string
+	}{
+		{nil, 0, "0000000000000000000000000000000000000000000000000000000000000001", "FF"},
+		{[]byte{0xAB}, 8, "AB00", "ABFF"},
+		{[]byte{0xA5}, 4, "A000", "AFFF"},
+		{[]byte{0xFF}, 1, "8000", "FFFF"},
+		{[]byte{0xAB, 0xCD, 0xEF}, 12, "ABC000", "ABCFFF"},
+		{[]byte{0xAB, 0xCD}, 15, "ABCC00", "ABCDFF"},
+	} {
+		start, end, err := PrefixRange(t.prefix, t.bits)
+		c.Assert(err, IsNil)
+		pad := func(s string, b byte) Hash {
+			for len(s) < HashSize*2 {
+				s += string(b)
+			}
+			return MustHash(s)
+		}
+		c.Assert(start, Equals, pad(t.start, '0'), Commentf("%X/%d", t.prefix, t.bits))
+		c.Assert(end, Equals, pad(t.end, 'F'), Commentf("%X/%d", t.prefix, t.bits))
+	}
+	full := bytes.Repeat([]byte{0x12}, HashSize)
+	start, end, err := PrefixRange(full, HashSize*8)
+	c.Assert(err, IsNil)
+	c.Assert(start, Equals, end)
+	for _, bits := range []int{-1, 9, HashSize*8 + 1} {
+		_, _, err := PrefixRange([]byte{0xAB}, bits)
+		c.Assert(err, NotNil)
+	}
+	_, _, err = PrefixRange(append(full, 0), HashSize*8+1)
+	c.Assert(err, NotNil)
+}
+
+func (s *KeyVaSuite) TestPrefix(c *C) {
+	db, err := NewMemoryDB(10, 1000, "Distance")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(5000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	prefix := kvs[0].Hash[:2]
+	for _, bits := range []int{0, 2, 5, 8, 11, 16} {
+		var expected KeySlice
+		for _, kv := range kvs {
+			if hasPrefix(kv.Hash, prefix, bits) {
+				expected = append(expected, kv.Key)
+			}
+		}
+		expected.Sort()
+		var walked, iterated HashSlice
+		err := db.PrefixBits(prefix, bits, func(kv *KeyValue) {
+			walked = append(walked, kv.Hash)
+		})
+		c.Assert(err, IsNil)
+		it, err := db.PrefixIterator(prefix, bits)
+		c.Assert(err, IsNil)
+		for it.Next() {
+			iterated = append(iterated, it.KeyValue().Hash)
+		}
+		c.Assert(it.Err(), IsNil)
+		c.Assert(walked, DeepEquals, expected.Hashes(), Commentf("%d bits", bits))
+		c.Assert(iterated, DeepEquals, walked, Commentf("%d bits", bits))
+	}
+	var matched int
+	c.Assert(db.Prefix(prefix, func(kv *KeyValue) { matched++ }), IsNil)
+	c.Assert(matched > 0, Equals, true)
+	c.Assert(db.Prefix(make([]byte, HashSize+1), func(*KeyValue) {}), NotNil)
+}
+
+// Values of keys read before a compaction are looked up again by hash
+func (s *KeyVaSuite) TestIteratorCompaction(c *C) {
+	db, err := NewMemoryDB(10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(1000)
+	c.Assert(err, IsNil)
+	values := make(map[Hash][]byte)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+		values[kv.Hash] = kv.Value
+	}
+	c.Assert(db.Flush(), IsNil)
+	for _, kv := range kvs[:500] {
+		value := append([]byte("updated"), kv.Value...)
+		c.Assert(db.Upsert(kv.Hash, value), IsNil)
+		values[kv.Hash] = value
+	}
+	c.Assert(db.Flush(), IsNil)
+	it := db.Iterator(FirstHash, LastHash)
+	var iterated int
+	for it.Next() {
+		if iterated == 0 {
+			c.Assert(db.Compact(nil), IsNil)
+		}
+		kv := it.KeyValue()
+		c.Assert(kv.Value, DeepEquals, values[kv.Hash])
+		iterated++
+	}
+	c.Assert(it.Err(), IsNil)
+	c.Assert(iterated, Equals, len(kvs))
+	c.Assert(db.Generation(), Equals, uint64(1))
+}
+
+// True if the first bits of hash and prefix match
+func hasPrefix(hash Hash, prefix []byte, bits int) bool {
+	for i := 0; i < bits; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		if hash[i/8]&mask != prefix[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
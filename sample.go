@@ -0,0 +1,64 @@
+package keyvadb
+
+import (
+	"context"
+	"math/big"
+	"math/rand"
+)
+
+// Sample returns up to n distinct flushed keys chosen at random. Each is
+// found by seeking to a random hash, so as hashes are uniformly
+// distributed every key is about equally likely to be chosen. If the
+// tree holds no more than twice n keys they are all read and n of them
+// are chosen exactly uniformly.
+func (db *DB) Sample(n int, rng *rand.Rand) (KeySlice, error) {
+	return db.SampleContext(context.Background(), n, rng)
+}
+
+func (db *DB) SampleContext(ctx context.Context, n int, rng *rand.Rand) (KeySlice, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	root, err := db.tree.node(ctx, RootNode)
+	if err != nil {
+		return nil, err
+	}
+	if root.Count <= uint64(2*n) {
+		return db.sampleAll(ctx, n, rng)
+	}
+	start := new(big.Int).SetBytes(root.Start[:])
+	span := hashSpan(root.Start, root.End)
+	seen := make(map[Hash]bool, n)
+	var sample KeySlice
+	for len(sample) < n {
+		offset := new(big.Int).Rand(rng, span)
+		var target Hash
+		offset.Add(offset, start).FillBytes(target[:])
+		key, err := db.tree.SeekContext(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[key.Hash] {
+			seen[key.Hash] = true
+			sample = append(sample, *key)
+		}
+	}
+	return sample, nil
+}
+
+// Chooses n keys from all of those in the tree
+func (db *DB) sampleAll(ctx context.Context, n int, rng *rand.Rand) (KeySlice, error) {
+	var keys KeySlice
+	err := db.tree.WalkContext(ctx, FirstHash, LastHash, func(key *Key) error {
+		keys = append(keys, *key)
+		return nil
+	})
+	if err != nil || len(keys) <= n {
+		return keys, err
+	}
+	sample := make(KeySlice, n)
+	for i, pick := range rng.Perm(len(keys))[:n] {
+		sample[i] = keys[pick]
+	}
+	return sample, nil
+}
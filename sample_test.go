@@ -0,0 +1,65 @@
+package keyvadb
+
+import (
+	"math/rand"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestSample(c *C) {
+	db, err := NewMemoryDB(10, 1000, "Distance")
+	c.Assert(err, IsNil)
+	rng := rand.New(rand.NewSource(1))
+	empty, err := db.Sample(10, rng)
+	c.Assert(err, IsNil)
+	c.Assert(empty, HasLen, 0)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(20000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	stored := make(map[Hash]bool)
+	for _, kv := range kvs {
+		stored[kv.Hash] = true
+	}
+
+	// Seeks past the last key wrap around to the first
+	hashes := kvs.Keys().Hashes()
+	hashes.Sort()
+	key, err := db.tree.Seek(hashes[len(hashes)-1])
+	c.Assert(err, IsNil)
+	c.Assert(key.Hash, Equals, hashes[len(hashes)-1])
+	key, err = db.tree.Seek(LastHash)
+	c.Assert(err, IsNil)
+	c.Assert(key.Hash, Equals, hashes[0])
+
+	// Sampled keys are stored, distinct and spread evenly over the hash
+	// space, checked with a chi-squared test over 16 ranges
+	sample, err := db.Sample(4000, rng)
+	c.Assert(err, IsNil)
+	c.Assert(sample, HasLen, 4000)
+	seen := make(map[Hash]bool)
+	var buckets [16]float64
+	for _, key := range sample {
+		c.Assert(seen[key.Hash], Equals, false)
+		seen[key.Hash] = true
+		c.Assert(stored[key.Hash], Equals, true)
+		buckets[key.Hash[0]>>4]++
+	}
+	var chiSquared float64
+	expected := float64(len(sample)) / float64(len(buckets))
+	for _, observed := range buckets {
+		chiSquared += (observed - expected) * (observed - expected) / expected
+	}
+	// Critical value for 15 degrees of freedom at p = 0.001
+	c.Assert(chiSquared < 37.7, Equals, true, Commentf("chi-squared: %f %v", chiSquared, buckets))
+
+	all, err := db.Sample(15000, rng)
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 15000)
+	all, err = db.Sample(30000, rng)
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 20000)
+}
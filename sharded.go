@@ -0,0 +1,234 @@
+package keyvadb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of values each shard may read ahead of the caller during a Range
+const shardRangeBuffer = 1024
+
+// Splits the hash space into equal ranges each held by its own DB
+type ShardedDB struct {
+	shards []*DB
+	// Smallest hash held by each shard
+	starts HashSlice
+}
+
+// Returns the smallest hash held by each of n shards
+func shardStarts(n int) HashSlice {
+	starts := HashSlice{FirstHash}
+	stride := FirstHash.Stride(LastHash, int64(n))
+	cursor := FirstHash
+	for i := 1; i < n; i++ {
+		cursor = cursor.Add(stride)
+		starts = append(starts, cursor)
+	}
+	return starts
+}
+
+func newShardedDB(n int, config func(i int) (*DBConfig, error)) (*ShardedDB, error) {
+	s := &ShardedDB{
+		starts: shardStarts(n),
+	}
+	for i := range s.starts {
+		conf, err := config(i)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		conf.start, conf.end = s.bounds(i)
+		db, err := newDB(conf)
+		if err != nil {
+			conf.close()
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, db)
+	}
+	return s, nil
+}
+
+func NewShardedMemoryDB(shards int, degree, batch uint64, balancer string) (*ShardedDB, error) {
+	return OpenSharded("", shards, &Options{
+		InMemory:  true,
+		Degree:    degree,
+		BatchSize: batch,
+		Balancer:  balancer,
+	})
+}
+
+// OpenSharded opens or creates a database of shards each stored in a
+// numbered subdirectory of dir. The number of shards is recorded in dir
+// and must match when reopened. Cache sizes are split evenly between
+// the shards.
+func OpenSharded(dir string, shards int, opts *Options) (*ShardedDB, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("shards must be 1 or above")
+	}
+	opts = opts.withDefaults()
+	opts.CacheSize /= int64(shards)
+	opts.ValueCacheSize /= int64(shards)
+	if opts.InMemory {
+		return newShardedDB(shards, func(int) (*DBConfig, error) {
+			return newDBConfig("", opts)
+		})
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "shards")
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(shards)+"\n"), 0666); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		existing, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt shard count in %s: %s", path, err)
+		}
+		if existing != shards {
+			return nil, fmt.Errorf("%s has %d shards not %d", dir, existing, shards)
+		}
+	}
+	return newShardedDB(shards, func(i int) (*DBConfig, error) {
+		shardDir := filepath.Join(dir, fmt.Sprintf("%03d", i))
+		if err := os.MkdirAll(shardDir, 0777); err != nil {
+			return nil, err
+		}
+		return newDBConfig(filepath.Join(shardDir, "db"), opts)
+	})
+}
+
+// Exclusive bounds of the tree of shard i
+func (s *ShardedDB) bounds(i int) (Hash, Hash) {
+	start, end := FirstHash, LastHash
+	if i > 0 {
+		start = s.starts[i].Previous()
+	}
+	if i < len(s.starts)-1 {
+		end = s.starts[i+1]
+	}
+	return start, end
+}
+
+func (s *ShardedDB) shard(hash Hash) int {
+	i := sort.Search(len(s.starts), func(i int) bool {
+		return s.starts[i].Greater(hash)
+	}) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func (s *ShardedDB) Shards() int {
+	return len(s.starts)
+}
+
+func (s *ShardedDB) Add(key Hash, value []byte) error {
+	return s.shards[s.shard(key)].Add(key, value)
+}
+
+func (s *ShardedDB) Get(hash Hash) (*KeyValue, error) {
+	return s.shards[s.shard(hash)].Get(hash)
+}
+
+// Range walks the shards overlapping start and end concurrently and
+// calls f in key order
+func (s *ShardedDB) Range(start, end Hash, f KeyValueFunc) error {
+	first, last := s.shard(start), s.shard(end)
+	done := make(chan struct{})
+	defer close(done)
+	results := make([]chan *KeyValue, last-first+1)
+	errs := make([]chan error, len(results))
+	for i := range results {
+		results[i], errs[i] = make(chan *KeyValue, shardRangeBuffer), make(chan error, 1)
+		go func(db *DB, kvs chan *KeyValue, errc chan error) {
+			defer close(kvs)
+			errc <- db.Range(start, end, func(kv *KeyValue) {
+				select {
+				case kvs <- kv:
+				case <-done:
+				}
+			})
+		}(s.shards[first+i], results[i], errs[i])
+	}
+	for i := range results {
+		for kv := range results[i] {
+			f(kv)
+		}
+		if err := <-errs[i]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All visits every value of each shard in turn
+func (s *ShardedDB) All(f KeyValueFunc) error {
+	for _, db := range s.shards {
+		if err := db.All(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls f for each shard concurrently and returns the first error
+func (s *ShardedDB) parallel(f func(*DB) error) error {
+	errs := make(chan error, len(s.shards))
+	var wg sync.WaitGroup
+	for _, db := range s.shards {
+		wg.Add(1)
+		go func(db *DB) {
+			defer wg.Done()
+			errs <- f(db)
+		}(db)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush flushes all shards in parallel
+func (s *ShardedDB) Flush() error {
+	return s.parallel((*DB).Flush)
+}
+
+func (s *ShardedDB) Sync() error {
+	return s.parallel((*DB).Sync)
+}
+
+func (s *ShardedDB) Close() error {
+	var first error
+	for _, db := range s.shards {
+		if err := db.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *ShardedDB) String() string {
+	lines := []string{fmt.Sprintf("Sharded DB: %d shards", len(s.shards))}
+	for i, db := range s.shards {
+		lines = append(lines, fmt.Sprintf("%03d: %s", i, db))
+	}
+	return strings.Join(lines, "\n")
+}
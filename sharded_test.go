@@ -0,0 +1,82 @@
+package keyvadb
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) testSharded(db *ShardedDB, c *C) {
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(10000)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	for _, kv := range kvs {
+		result, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(result.Value, DeepEquals, kv.Value)
+	}
+	keys := kvs.Keys()
+	keys.Sort()
+	for _, shard := range db.shards {
+		c.Assert(shard.Verify(nil), IsNil)
+	}
+	i := 0
+	err = db.Range(FirstHash, LastHash, func(kv *KeyValue) {
+		c.Assert(kv.Hash, Equals, keys[i].Hash)
+		i++
+	})
+	c.Assert(err, IsNil)
+	c.Assert(i, Equals, len(keys))
+	// Subset spanning several shards
+	i = 1000
+	err = db.Range(keys[i].Hash, keys[len(keys)-1000].Hash, func(kv *KeyValue) {
+		c.Assert(kv.Hash, Equals, keys[i].Hash)
+		i++
+	})
+	c.Assert(err, IsNil)
+	c.Assert(i, Equals, len(keys)-999)
+}
+
+func (s *KeyVaSuite) TestShardedMemoryDB(c *C) {
+	db, err := NewShardedMemoryDB(7, 10, 100000, "Distance")
+	c.Assert(err, IsNil)
+	c.Assert(db.Shards(), Equals, 7)
+	s.testSharded(db, c)
+}
+
+func (s *KeyVaSuite) TestShardedFileDB(c *C) {
+	os.RemoveAll("sharded")
+	defer os.RemoveAll("sharded")
+	db, err := OpenSharded("sharded", 4, &Options{
+		BatchSize: 100000,
+		Mmap:      true,
+		Sync:      SyncPolicy{Durability: GroupCommit},
+	})
+	c.Assert(err, IsNil)
+	s.testSharded(db, c)
+	c.Assert(db.Close(), IsNil)
+	_, err = OpenSharded("sharded", 5, nil)
+	c.Assert(err, NotNil)
+
+	// The shards opened before one which fails are closed
+	c.Assert(os.Truncate("sharded/002/db.keys", 100), IsNil)
+	fds := func() int {
+		files, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			c.Skip("open files are not listed")
+		}
+		return len(files)
+	}
+	// Counted after the first failure, which may open the log
+	_, err = OpenSharded("sharded", 4, nil)
+	c.Assert(err, NotNil)
+	before := fds()
+	_, err = OpenSharded("sharded", 4, nil)
+	c.Assert(err, NotNil)
+	c.Assert(fds(), Equals, before)
+}
@@ -1,6 +1,7 @@
 package keyvadb
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"strings"
@@ -46,10 +47,14 @@ type Summary struct {
 }
 
 func NewSummary(tree *Tree) (*Summary, error) {
+	return NewSummaryContext(context.Background(), tree)
+}
+
+func NewSummaryContext(ctx context.Context, tree *Tree) (*Summary, error) {
 	sum := &Summary{
 		Degree: tree.Degree,
 	}
-	err := tree.Each(func(level int, n *Node) error {
+	err := tree.EachContext(ctx, func(level int, n *Node) error {
 		if level >= len(sum.Levels) {
 			sum.Levels = append(sum.Levels, Level{})
 		}
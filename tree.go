@@ -1,76 +1,253 @@
 package keyvadb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 type Tree struct {
-	Degree   uint64
-	keys     KeyStore
-	balancer Balancer
+	Degree uint64
+	// Maximum number of nodes balanced concurrently by Add. The shape
+	// of the tree only depends on the keys added with DistanceBalancer,
+	// BufferBalancer's random choices depend on the order nodes are
+	// balanced in.
+	Workers int
+	// Called with each node created by Add
+	OnNodeAlloc func(n *Node)
+	keys        KeyStore
+	balancer    Balancer
 }
 
 func NewTree(degree uint64, keys KeyStore, balancer Balancer) (*Tree, error) {
+	return newRangeTree(degree, FirstHash, LastHash, keys, balancer)
+}
+
+// Creates a tree whose root only spans the hashes between start and end exclusive
+func newRangeTree(degree uint64, start, end Hash, keys KeyStore, balancer Balancer) (*Tree, error) {
 	if degree < 2 {
 		return nil, fmt.Errorf("degree must be 2 or above")
 	}
-	root := NewNode(FirstHash, LastHash, RootNode, degree)
-	root.AddSyntheticKeys()
-	if err := keys.Set(root); err != nil {
-		return nil, err
-	}
-	return &Tree{
+	tree := &Tree{
 		Degree:   degree,
+		Workers:  runtime.NumCPU(),
 		keys:     keys,
 		balancer: balancer,
-	}, nil
+	}
+	// Only create a root for an empty key store
+	if keys.Length() == 0 {
+		root := NewNode(start, end, RootNode, degree)
+		root.AddSyntheticKeys()
+		if err := keys.Set(root); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	}
+	root, err := keys.Get(RootNode, degree)
+	if err != nil {
+		return nil, err
+	}
+	if root.format == 0 {
+		// Written before nodes held digests and counts
+		if _, _, err := tree.rebuildDigests(context.Background(), RootNode); err != nil {
+			return nil, err
+		}
+		if err := keys.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
 }
 
-func (t *Tree) add(n *Node, keys KeySlice, journal Journal) (insertions int, err error) {
-	if len(keys) == 0 {
-		panic("no values to add")
+// Recomputes the digests and counts below and including id and writes the
+// nodes in the current format. The root is written last, so a rebuild
+// which is interrupted is started again on the next open.
+func (t *Tree) rebuildDigests(ctx context.Context, id NodeId) (Hash, uint64, error) {
+	n, err := t.node(ctx, id)
+	if err != nil {
+		return EmptyKey, 0, err
 	}
-	debugPrintln(n)
-	current, remainder := t.balancer.Balance(n, keys)
-	insertions = len(keys) - len(remainder)
-	if *debug && !current.SanityCheck() {
-		panic(fmt.Sprintf("not sane:\n%s", n))
+	digest, count := n.OwnDigest()
+	for _, cid := range n.Children {
+		if cid.Empty() {
+			continue
+		}
+		childDigest, childCount, err := t.rebuildDigests(ctx, cid)
+		if err != nil {
+			return EmptyKey, 0, err
+		}
+		digest = digest.Xor(childDigest)
+		count += childCount
 	}
-	err = current.Each(func(i int, cid NodeId, start, end Hash) error {
-		candidates := remainder.GetRange(start, end)
-		if len(candidates) == 0 {
-			return nil
+	rebuilt := n.Clone()
+	rebuilt.Digest, rebuilt.Count = digest, count
+	return digest, count, t.keys.Set(rebuilt)
+}
+
+// State of one node while a batch of keys is added
+type insertion struct {
+	// Node before the batch is added
+	previous *Node
+	current  *Node
+	id       NodeId
+	keys     KeySlice
+	// Keys left for the children of this node
+	remainder KeySlice
+	parent    *insertion
+	// Keys inserted below and including this node, duplicates included
+	insertions int
+	// Change to digest and count of this node from keys added below
+	// and including it. added wraps if keys are moved down to
+	// children, which the children's counts then make good.
+	change Hash
+	added  uint64
+}
+
+// Reads the node if it already exists and balances the keys into it
+func (t *Tree) balance(ins *insertion) error {
+	if len(ins.keys) == 0 {
+		panic("no values to add")
+	}
+	if ins.previous == nil {
+		n, err := t.keys.Get(ins.id, t.Degree)
+		if err != nil {
+			return err
 		}
-		var child *Node
-		if cid.Empty() {
-			if child, err = t.keys.New(start, end, t.Degree); err != nil {
+		ins.previous = n
+	}
+	debugPrintln(ins.previous)
+	ins.current, ins.remainder = t.balancer.Balance(ins.previous, ins.keys)
+	ins.insertions = len(ins.keys) - len(ins.remainder)
+	if *debug && !ins.current.SanityCheck() {
+		panic(fmt.Sprintf("not sane:\n%s", ins.previous))
+	}
+	before, beforeCount := ins.previous.OwnDigest()
+	after, afterCount := ins.current.OwnDigest()
+	ins.change, ins.added = before.Xor(after), afterCount-beforeCount
+	return nil
+}
+
+// Calls f for each insertion using up to t.Workers goroutines and
+// returns the error of the earliest failing insertion
+func (t *Tree) parallel(level []*insertion, f func(*insertion) error) error {
+	workers := t.Workers
+	if len(level) < workers {
+		workers = len(level)
+	}
+	if workers <= 1 {
+		for _, ins := range level {
+			if err := f(ins); err != nil {
 				return err
 			}
-			current = current.CloneIfClean()
-			current.Children[i] = child.Id
-		} else {
-			if child, err = t.keys.Get(cid, t.Degree); err != nil {
-				return err
+		}
+		return nil
+	}
+	errs := make([]error, len(level))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				errs[j] = f(level[j])
 			}
+		}()
+	}
+	for j := range level {
+		next <- j
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
-		childInsertions, err := t.add(child, candidates, journal)
-		insertions += childInsertions
-		return err
-	})
-	debugPrintln(current)
-	if err != nil {
-		return
 	}
-	if current.Dirty {
-		journal.Swap(current, n)
+	return nil
+}
+
+// Adds keys a level at a time. The nodes of each level are read and
+// balanced concurrently, then new children are allocated in key order
+// so that node ids and the journal do not depend on scheduling.
+// Cancellation is only checked before the journal is changed.
+func (t *Tree) add(ctx context.Context, root *Node, keys KeySlice, journal Journal) (int, error) {
+	var levels [][]*insertion
+	for level := []*insertion{{id: root.Id, previous: root, keys: keys}}; len(level) > 0; {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := t.parallel(level, t.balance); err != nil {
+			return 0, err
+		}
+		levels = append(levels, level)
+		var next []*insertion
+		for _, ins := range level {
+			err := ins.current.Each(func(i int, cid NodeId, start, end Hash) error {
+				candidates := ins.remainder.GetRange(start, end)
+				if len(candidates) == 0 {
+					return nil
+				}
+				child := &insertion{
+					id:     cid,
+					keys:   candidates,
+					parent: ins,
+				}
+				if cid.Empty() {
+					n, err := t.keys.New(start, end, t.Degree)
+					if err != nil {
+						return err
+					}
+					if t.OnNodeAlloc != nil {
+						t.OnNodeAlloc(n)
+					}
+					child.previous = n
+					ins.current = ins.current.CloneIfClean()
+					ins.current.Children[i] = n.Id
+				}
+				next = append(next, child)
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+		level = next
+	}
+	// Propagate digests and counts from the leaves up
+	for i := len(levels) - 1; i >= 0; i-- {
+		for _, ins := range levels[i] {
+			if ins.added > 0 {
+				ins.current = ins.current.CloneIfClean()
+				ins.current.Digest = ins.current.Digest.Xor(ins.change)
+				ins.current.Count += ins.added
+			}
+			debugPrintln(ins.current)
+			if ins.current.Dirty {
+				journal.Swap(ins.current, ins.previous)
+			}
+			if parent := ins.parent; parent != nil {
+				parent.insertions += ins.insertions
+				parent.change = parent.change.Xor(ins.change)
+				parent.added += ins.added
+			}
+		}
 	}
-	return
+	return levels[0][0].insertions, nil
 }
 
 // Returns number of keys inserted and an error if encountered
 func (t *Tree) Add(keys KeySlice, journal Journal) (int, error) {
+	return t.AddContext(context.Background(), keys, journal)
+}
+
+func (t *Tree) AddContext(ctx context.Context, keys KeySlice, journal Journal) (int, error) {
 	if !keys.IsSorted() {
 		return 0, fmt.Errorf("unsorted values provided")
 	}
@@ -79,24 +256,107 @@ func (t *Tree) Add(keys KeySlice, journal Journal) (int, error) {
 	if len(unique) < len(keys) {
 		return 0, fmt.Errorf("values provided are not unique")
 	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	root, err := t.keys.Get(RootNode, t.Degree)
 	if err != nil {
 		return 0, fmt.Errorf("cannot get root node: %s", err.Error())
 	}
-	return t.add(root, unique, journal)
+	return t.add(ctx, root, unique, journal)
+}
+
+// Replaces the ValueId of each key whose hash is already in the tree
+// and returns the number replaced. Keys not in the tree are ignored.
+func (t *Tree) Replace(keys KeySlice, journal Journal) (int, error) {
+	return t.ReplaceContext(context.Background(), keys, journal)
+}
+
+func (t *Tree) ReplaceContext(ctx context.Context, keys KeySlice, journal Journal) (int, error) {
+	// Each node is swapped once however many of its keys are replaced,
+	// nodes already swapped into the journal are changed in place
+	changed := make(map[NodeId]*Delta)
+	var order []NodeId
+	replaced := 0
+	for _, key := range keys {
+		n, i, err := t.find(ctx, RootNode, key.Hash, journal)
+		switch {
+		case err == ErrNotFound:
+			continue
+		case err != nil:
+			return 0, err
+		case n.Keys[i].Id == key.Id:
+			continue
+		}
+		current := journal.Pending(n.Id)
+		if current == nil {
+			delta, ok := changed[n.Id]
+			if !ok {
+				clone := n.Clone()
+				clone.Dirty = true
+				delta = &Delta{current: clone, previous: n}
+				changed[n.Id] = delta
+				order = append(order, n.Id)
+			}
+			current = delta.current
+		}
+		current.Keys[i].Id = key.Id
+		replaced++
+	}
+	for _, id := range order {
+		journal.Swap(changed[id].current, changed[id].previous)
+	}
+	return replaced, nil
+}
+
+// Returns the node holding hash and the index of its key, reading the
+// nodes pending in journal in place of those they replace
+func (t *Tree) find(ctx context.Context, id NodeId, hash Hash, journal Journal) (*Node, int, error) {
+	n := journal.Pending(id)
+	if n == nil {
+		var err error
+		if n, err = t.node(ctx, id); err != nil {
+			return nil, 0, err
+		}
+	}
+	for i, key := range n.Keys {
+		if key.Hash.Equals(hash) && !key.Id.Synthetic() {
+			return n, i, nil
+		}
+	}
+	for i, cid := range n.Children {
+		if cid.Empty() {
+			continue
+		}
+		if s, e := n.GetChildRange(i); !hash.Less(s) && !hash.Greater(e) {
+			found, index, err := t.find(ctx, cid, hash, journal)
+			if err != ErrNotFound {
+				return found, index, err
+			}
+		}
+	}
+	return nil, 0, ErrNotFound
+}
+
+// Reads a node unless ctx is done
+func (t *Tree) node(ctx context.Context, id NodeId) (*Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.keys.Get(id, t.Degree)
 }
 
 type WalkFunc func(key *Key) error
 
-func (t *Tree) walk(id NodeId, start, end Hash, f WalkFunc) error {
-	n, err := t.keys.Get(id, t.Degree)
+func (t *Tree) walk(ctx context.Context, id NodeId, start, end Hash, f WalkFunc) error {
+	n, err := t.node(ctx, id)
 	if err != nil {
 		return err
 	}
 	for i, cid := range n.Children {
 		if !cid.Empty() {
 			if s, e := n.GetChildRange(i); !end.Less(s) && !start.Greater(e) {
-				if err := t.walk(cid, start, end, f); err != nil {
+				if err := t.walk(ctx, cid, start, end, f); err != nil {
 					return err
 				}
 			}
@@ -115,12 +375,20 @@ func (t *Tree) walk(id NodeId, start, end Hash, f WalkFunc) error {
 
 // Walk the tree in key order from start to end inclusive
 func (t *Tree) Walk(start, end Hash, f WalkFunc) error {
-	return t.walk(RootNode, start, end, f)
+	return t.WalkContext(context.Background(), start, end, f)
+}
+
+func (t *Tree) WalkContext(ctx context.Context, start, end Hash, f WalkFunc) error {
+	return t.walk(ctx, RootNode, start, end, f)
 }
 
 func (t *Tree) Get(hash Hash) (*Key, error) {
+	return t.GetContext(context.Background(), hash)
+}
+
+func (t *Tree) GetContext(ctx context.Context, hash Hash) (*Key, error) {
 	var result *Key
-	err := t.walk(RootNode, hash, hash, func(key *Key) error {
+	err := t.walk(ctx, RootNode, hash, hash, func(key *Key) error {
 		result = key
 		return nil
 	})
@@ -134,8 +402,230 @@ func (t *Tree) Get(hash Hash) (*Key, error) {
 	}
 }
 
-func (t *Tree) each(id NodeId, level int, f NodeFunc) error {
-	n, err := t.keys.Get(id, t.Degree)
+// MultiGet returns the keys found for sorted hashes by their hashes.
+// Each node is read once however many of the hashes lie beneath it.
+func (t *Tree) MultiGet(hashes HashSlice) (map[Hash]*Key, error) {
+	return t.MultiGetContext(context.Background(), hashes)
+}
+
+func (t *Tree) MultiGetContext(ctx context.Context, hashes HashSlice) (map[Hash]*Key, error) {
+	if !hashes.IsSorted() {
+		return nil, fmt.Errorf("unsorted hashes provided")
+	}
+	found := make(map[Hash]*Key, len(hashes))
+	if len(hashes) == 0 {
+		return found, nil
+	}
+	return found, t.multiGet(ctx, RootNode, hashes, found)
+}
+
+func (t *Tree) multiGet(ctx context.Context, id NodeId, hashes HashSlice, found map[Hash]*Key) error {
+	n, err := t.node(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		i := n.Keys.find(hash)
+		if i < len(n.Keys) && n.Keys[i].Hash.Equals(hash) && !n.Keys[i].Empty() && !n.Keys[i].Id.Synthetic() {
+			found[hash] = n.Keys[i].Clone()
+		}
+	}
+	for i, cid := range n.Children {
+		if cid.Empty() {
+			continue
+		}
+		if within := hashes.GetRange(n.GetChildRange(i)); len(within) > 0 {
+			if err := t.multiGet(ctx, cid, within, found); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returned by a WalkFunc to end a walk early
+var errStopWalk = errors.New("walk stopped")
+
+// Seek returns the first key at or after target, wrapping around to the
+// first key of the tree if there is none. It returns ErrNotFound if the
+// tree is empty.
+func (t *Tree) Seek(target Hash) (*Key, error) {
+	return t.SeekContext(context.Background(), target)
+}
+
+func (t *Tree) SeekContext(ctx context.Context, target Hash) (*Key, error) {
+	var found *Key
+	first := func(key *Key) error {
+		found = key
+		return errStopWalk
+	}
+	for _, start := range []Hash{target, FirstHash} {
+		switch err := t.walk(ctx, RootNode, start, LastHash, first); err {
+		case errStopWalk:
+			return found, nil
+		case nil:
+			continue
+		default:
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (t *Tree) digest(ctx context.Context, id NodeId, start, end Hash) (Hash, uint64, error) {
+	n, err := t.node(ctx, id)
+	if err != nil {
+		return EmptyKey, 0, err
+	}
+	if start.Compare(n.Start) <= 0 && end.Compare(n.End) >= 0 {
+		return n.Digest, n.Count, nil
+	}
+	var digest Hash
+	var count uint64
+	for i, cid := range n.Children {
+		if !cid.Empty() {
+			if s, e := n.GetChildRange(i); !end.Less(s) && !start.Greater(e) {
+				childDigest, childCount, err := t.digest(ctx, cid, start, end)
+				if err != nil {
+					return EmptyKey, 0, err
+				}
+				digest = digest.Xor(childDigest)
+				count += childCount
+			}
+		}
+		if i < n.MaxEntries() {
+			key := n.Keys[i]
+			if start.Compare(key.Hash) <= 0 && end.Compare(key.Hash) >= 0 && !key.Id.Synthetic() {
+				digest = digest.Xor(key.Hash)
+				count++
+			}
+		}
+	}
+	return digest, count, nil
+}
+
+// Returns the XOR of all hashes from start to end inclusive and their count.
+// Only subtrees partially overlapping the range are descended into,
+// so the result is independent of the shape of the tree.
+func (t *Tree) Digest(start, end Hash) (Hash, uint64, error) {
+	return t.DigestContext(context.Background(), start, end)
+}
+
+func (t *Tree) DigestContext(ctx context.Context, start, end Hash) (Hash, uint64, error) {
+	return t.digest(ctx, RootNode, start, end)
+}
+
+// Count returns the number of keys from start to end inclusive, reading
+// only the nodes which partially overlap the range
+func (t *Tree) Count(start, end Hash) (uint64, error) {
+	return t.CountContext(context.Background(), start, end)
+}
+
+func (t *Tree) CountContext(ctx context.Context, start, end Hash) (uint64, error) {
+	_, count, err := t.digest(ctx, RootNode, start, end)
+	return count, err
+}
+
+// Levels of the tree read by EstimateCount
+const estimateLevels = 2
+
+// EstimateCount returns the number of keys from start to end inclusive,
+// reading only the nodes of the top levels. Below those the
+// keys of a subtree partially overlapping the range are assumed to be
+// spread uniformly over the hashes it spans.
+func (t *Tree) EstimateCount(start, end Hash) (uint64, error) {
+	return t.EstimateCountContext(context.Background(), start, end)
+}
+
+func (t *Tree) EstimateCountContext(ctx context.Context, start, end Hash) (uint64, error) {
+	if end.Less(start) {
+		return 0, nil
+	}
+	estimate, err := t.estimate(ctx, RootNode, start, end, estimateLevels)
+	return uint64(math.Round(estimate)), err
+}
+
+func (t *Tree) estimate(ctx context.Context, id NodeId, start, end Hash, levels int) (float64, error) {
+	n, err := t.node(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if start.Compare(n.Start) <= 0 && end.Compare(n.End) >= 0 {
+		return float64(n.Count), nil
+	}
+	if levels == 1 {
+		if start.Less(n.Start) {
+			start = n.Start
+		}
+		if end.Greater(n.End) {
+			end = n.End
+		}
+		share, _ := new(big.Rat).SetFrac(hashSpan(start, end), hashSpan(n.Start, n.End)).Float64()
+		return share * float64(n.Count), nil
+	}
+	var estimate float64
+	for i, cid := range n.Children {
+		if !cid.Empty() {
+			if s, e := n.GetChildRange(i); !end.Less(s) && !start.Greater(e) {
+				childEstimate, err := t.estimate(ctx, cid, start, end, levels-1)
+				if err != nil {
+					return 0, err
+				}
+				estimate += childEstimate
+			}
+		}
+		if i < n.MaxEntries() {
+			key := n.Keys[i]
+			if start.Compare(key.Hash) <= 0 && end.Compare(key.Hash) >= 0 && !key.Id.Synthetic() {
+				estimate++
+			}
+		}
+	}
+	return estimate, nil
+}
+
+// Number of hashes from start to end inclusive
+func hashSpan(start, end Hash) *big.Int {
+	span := new(big.Int).SetBytes(end[:])
+	span.Sub(span, new(big.Int).SetBytes(start[:]))
+	return span.Add(span, big.NewInt(1))
+}
+
+func (t *Tree) checkDigest(ctx context.Context, id NodeId) (Hash, uint64, error) {
+	n, err := t.node(ctx, id)
+	if err != nil {
+		return EmptyKey, 0, err
+	}
+	digest, count := n.OwnDigest()
+	for _, cid := range n.Children {
+		if cid.Empty() {
+			continue
+		}
+		childDigest, childCount, err := t.checkDigest(ctx, cid)
+		if err != nil {
+			return EmptyKey, 0, err
+		}
+		digest = digest.Xor(childDigest)
+		count += childCount
+	}
+	if digest != n.Digest || count != n.Count {
+		return EmptyKey, 0, fmt.Errorf("Node %d has digest %s count %d expected %s count %d", n.Id, n.Digest, n.Count, digest, count)
+	}
+	return digest, count, nil
+}
+
+// Recomputes every digest from the keys and checks it against the one stored
+func (t *Tree) CheckDigests() error {
+	return t.CheckDigestsContext(context.Background())
+}
+
+func (t *Tree) CheckDigestsContext(ctx context.Context) error {
+	_, _, err := t.checkDigest(ctx, RootNode)
+	return err
+}
+
+func (t *Tree) each(ctx context.Context, id NodeId, level int, f NodeFunc) error {
+	n, err := t.node(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -146,17 +636,25 @@ func (t *Tree) each(id NodeId, level int, f NodeFunc) error {
 		if cid.Empty() {
 			return nil
 		}
-		return t.each(cid, level+1, f)
+		return t.each(ctx, cid, level+1, f)
 	})
 }
 
 // Visit each node
 func (t *Tree) Each(f NodeFunc) error {
-	return t.each(RootNode, 0, f)
+	return t.EachContext(context.Background(), f)
+}
+
+func (t *Tree) EachContext(ctx context.Context, f NodeFunc) error {
+	return t.each(ctx, RootNode, 0, f)
 }
 
 func (t *Tree) Dump(w io.Writer) error {
-	return t.Each(func(level int, n *Node) error {
+	return t.DumpContext(context.Background(), w)
+}
+
+func (t *Tree) DumpContext(ctx context.Context, w io.Writer) error {
+	return t.EachContext(ctx, func(level int, n *Node) error {
 		indent := strings.Repeat("\t", level)
 		for _, line := range strings.Split(n.String(), "\n") {
 			if _, err := fmt.Fprintf(w, "%s%s\n", indent, line); err != nil {
@@ -1,6 +1,10 @@
 package keyvadb
 
-import . "gopkg.in/check.v1"
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
 
 func (s *KeyVaSuite) TestTree(c *C) {
 	for _, b := range Balancers {
@@ -69,3 +73,113 @@ func (s *KeyVaSuite) TestTree(c *C) {
 		c.Assert(j, Equals, len(allKeys)-99)
 	}
 }
+
+// DistanceBalancer builds the same tree whatever the number of workers,
+// BufferBalancer the same contents
+func (s *KeyVaSuite) TestParallelTree(c *C) {
+	for _, b := range Balancers {
+		msg := Commentf(b.Name)
+		var dumps []string
+		var contents []KeySlice
+		for _, workers := range []int{1, 8} {
+			// Same keys for each tree
+			s.SetUpTest(c)
+			gen := NewRandomValueGenerator(10, 50, s.R)
+			keys := NewMemoryKeyStore()
+			values := NewMemoryValueStore()
+			tree, err := NewTree(8, keys, b.Balancer)
+			c.Assert(err, IsNil, msg)
+			tree.Workers = workers
+			journal := NewSimpleJournal("test", keys, values)
+			for i := 0; i < 5; i++ {
+				kv, err := gen.Take(1000)
+				c.Assert(err, IsNil, msg)
+				keys := kv.Keys()
+				keys.Sort()
+				n, err := tree.Add(keys, journal)
+				c.Assert(err, IsNil, msg)
+				c.Assert(n, Equals, len(keys), msg)
+				c.Assert(journal.Commit(), IsNil, msg)
+			}
+			c.Assert(tree.CheckDigests(), IsNil, msg)
+			var dump bytes.Buffer
+			c.Assert(tree.Dump(&dump), IsNil, msg)
+			dumps = append(dumps, dump.String())
+			var content KeySlice
+			c.Assert(tree.Walk(FirstHash, LastHash, func(key *Key) error {
+				content = append(content, *key)
+				return nil
+			}), IsNil, msg)
+			c.Assert(content, HasLen, 5000, msg)
+			contents = append(contents, content)
+		}
+		c.Assert(contents[0], DeepEquals, contents[1], msg)
+		if b.Name == "Distance" {
+			c.Assert(dumps[0], Equals, dumps[1], msg)
+		}
+	}
+}
+
+// Counts the nodes read from a KeyStore
+type countingKeyStore struct {
+	KeyStore
+	gets int
+}
+
+func (s *countingKeyStore) Get(id NodeId, degree uint64) (*Node, error) {
+	s.gets++
+	return s.KeyStore.Get(id, degree)
+}
+
+func (s *KeyVaSuite) TestNearest(c *C) {
+	keys := &countingKeyStore{KeyStore: NewMemoryKeyStore()}
+	tree, err := NewTree(8, keys, &DistanceBalancer{})
+	c.Assert(err, IsNil)
+	journal := NewSimpleJournal("test", keys, NewMemoryValueStore())
+	gen := NewRandomValueGenerator(10, 50, s.R)
+	kvs, err := gen.Take(10000)
+	c.Assert(err, IsNil)
+	all := kvs.Keys()
+	all.Sort()
+	_, err = tree.Add(all, journal)
+	c.Assert(err, IsNil)
+	c.Assert(journal.Commit(), IsNil)
+	summary, err := NewSummary(tree)
+	c.Assert(err, IsNil)
+	targets, err := gen.Take(20)
+	c.Assert(err, IsNil)
+	for _, target := range targets.Keys().Hashes() {
+		for _, m := range []struct {
+			nearest  func(Hash, int) (KeySlice, error)
+			distance func(a, b Hash) Hash
+		}{
+			{tree.Nearest, Hash.Distance},
+			{tree.NearestXOR, Hash.Xor},
+		} {
+			keys.gets = 0
+			nearest, err := m.nearest(target, 10)
+			c.Assert(err, IsNil)
+			c.Assert(nearest, HasLen, 10)
+			c.Assert(keys.gets < int(summary.Total.Nodes)/10, Equals, true, Commentf("%d of %d nodes read", keys.gets, summary.Total.Nodes))
+			// No other key is nearer than the furthest found
+			furthest := m.distance(nearest[9].Hash, target)
+			found := make(map[Hash]bool)
+			for i, key := range nearest {
+				found[key.Hash] = true
+				if i > 0 {
+					c.Assert(m.distance(nearest[i-1].Hash, target).Greater(m.distance(key.Hash, target)), Equals, false)
+				}
+			}
+			for _, key := range all {
+				if !found[key.Hash] {
+					c.Assert(m.distance(key.Hash, target).Less(furthest), Equals, false)
+				}
+			}
+		}
+	}
+	empty, err := NewTree(8, NewMemoryKeyStore(), &DistanceBalancer{})
+	c.Assert(err, IsNil)
+	nearest, err := empty.Nearest(FirstHash, 3)
+	c.Assert(err, IsNil)
+	c.Assert(nearest, HasLen, 0)
+}
@@ -0,0 +1,158 @@
+package keyvadb
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Unsigned 256 bit integer as four little endian limbs
+type uint256 [4]uint64
+
+func (h Hash) uint256() uint256 {
+	return uint256{
+		binary.BigEndian.Uint64(h[24:]),
+		binary.BigEndian.Uint64(h[16:]),
+		binary.BigEndian.Uint64(h[8:]),
+		binary.BigEndian.Uint64(h[:]),
+	}
+}
+
+func (x uint256) hash() Hash {
+	var h Hash
+	binary.BigEndian.PutUint64(h[24:], x[0])
+	binary.BigEndian.PutUint64(h[16:], x[1])
+	binary.BigEndian.PutUint64(h[8:], x[2])
+	binary.BigEndian.PutUint64(h[:], x[3])
+	return h
+}
+
+func (x uint256) cmp(y uint256) int {
+	for i := 3; i >= 0; i-- {
+		switch {
+		case x[i] < y[i]:
+			return -1
+		case x[i] > y[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+func (x uint256) isZero() bool {
+	return x[0]|x[1]|x[2]|x[3] == 0
+}
+
+// Returns x+y and the carry out
+func (x uint256) add(y uint256) (uint256, uint64) {
+	var z uint256
+	var carry uint64
+	z[0], carry = bits.Add64(x[0], y[0], 0)
+	z[1], carry = bits.Add64(x[1], y[1], carry)
+	z[2], carry = bits.Add64(x[2], y[2], carry)
+	z[3], carry = bits.Add64(x[3], y[3], carry)
+	return z, carry
+}
+
+// Returns x-y and the borrow out
+func (x uint256) sub(y uint256) (uint256, uint64) {
+	var z uint256
+	var borrow uint64
+	z[0], borrow = bits.Sub64(x[0], y[0], 0)
+	z[1], borrow = bits.Sub64(x[1], y[1], borrow)
+	z[2], borrow = bits.Sub64(x[2], y[2], borrow)
+	z[3], borrow = bits.Sub64(x[3], y[3], borrow)
+	return z, borrow
+}
+
+// Number of limbs up to and including the most significant non zero limb
+func (x uint256) limbs() int {
+	for i := 3; i >= 0; i-- {
+		if x[i] != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Returns x/d and x%d, panics if d is zero
+func (x uint256) divRem64(d uint64) (uint256, uint64) {
+	var q uint256
+	var r uint64
+	for i := 3; i >= 0; i-- {
+		q[i], r = bits.Div64(r, x[i], d)
+	}
+	return q, r
+}
+
+// Returns x/d and x%d using Knuth's Algorithm D, panics if d is zero
+func (x uint256) divRem(d uint256) (uint256, uint256) {
+	n := d.limbs()
+	switch {
+	case n == 0:
+		panic("division by zero")
+	case x.cmp(d) < 0:
+		return uint256{}, x
+	case n == 1:
+		q, r := x.divRem64(d[0])
+		return q, uint256{r}
+	}
+	m := x.limbs()
+	// Normalise so the top limb of the divisor has its high bit set
+	shift := uint(bits.LeadingZeros64(d[n-1]))
+	var dn uint256
+	for i := n - 1; i > 0; i-- {
+		dn[i] = d[i]<<shift | d[i-1]>>(64-shift)
+	}
+	dn[0] = d[0] << shift
+	var un [5]uint64
+	un[m] = x[m-1] >> (64 - shift)
+	for i := m - 1; i > 0; i-- {
+		un[i] = x[i]<<shift | x[i-1]>>(64-shift)
+	}
+	un[0] = x[0] << shift
+	var q uint256
+	for j := m - n; j >= 0; j-- {
+		// Estimate the quotient limb from the top two limbs
+		var qhat, rhat, carry uint64
+		if un[j+n] >= dn[n-1] {
+			qhat = ^uint64(0)
+			rhat, carry = bits.Add64(un[j+n-1], dn[n-1], 0)
+		} else {
+			qhat, rhat = bits.Div64(un[j+n], un[j+n-1], dn[n-1])
+		}
+		// Refine using the next limb, at most one too large afterwards
+		for carry == 0 {
+			hi, lo := bits.Mul64(qhat, dn[n-2])
+			if hi < rhat || (hi == rhat && lo <= un[j+n-2]) {
+				break
+			}
+			qhat--
+			rhat, carry = bits.Add64(rhat, dn[n-1], 0)
+		}
+		// Multiply and subtract
+		var borrow, mulCarry uint64
+		for i := 0; i < n; i++ {
+			hi, lo := bits.Mul64(qhat, dn[i])
+			lo, c := bits.Add64(lo, mulCarry, 0)
+			mulCarry = hi + c
+			un[i+j], borrow = bits.Sub64(un[i+j], lo, borrow)
+		}
+		un[j+n], borrow = bits.Sub64(un[j+n], mulCarry, borrow)
+		// Add back if the estimate was one too large
+		if borrow != 0 {
+			qhat--
+			var c uint64
+			for i := 0; i < n; i++ {
+				un[i+j], c = bits.Add64(un[i+j], dn[i], c)
+			}
+			un[j+n] += c
+		}
+		q[j] = qhat
+	}
+	var r uint256
+	for i := 0; i < n-1; i++ {
+		r[i] = un[i]>>shift | un[i+1]<<(64-shift)
+	}
+	r[n-1] = un[n-1] >> shift
+	return q, r
+}
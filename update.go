@@ -0,0 +1,108 @@
+package keyvadb
+
+import "context"
+
+// Upsert adds value under key, replacing the value of any existing key
+// once flushed. Add leaves an existing key's value unchanged. With a
+// KeyHasher the original key of an existing value is kept, see UpsertKey.
+func (db *DB) Upsert(key Hash, value []byte) error {
+	return db.UpsertContext(context.Background(), key, value)
+}
+
+func (db *DB) UpsertContext(ctx context.Context, key Hash, value []byte) error {
+	return db.upsert(ctx, key, nil, value)
+}
+
+// Replaces the value of key, keeping its current original key if raw is nil
+func (db *DB) upsert(ctx context.Context, key Hash, raw, value []byte) error {
+	if err := db.checkContent(key, value); err != nil {
+		return err
+	}
+	lock := db.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if db.KeyHasher != nil && raw == nil {
+		switch current, err := db.GetContext(ctx, key); err {
+		case nil:
+			raw = current.RawKey
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+	return db.add(ctx, key, raw, value, true)
+}
+
+// PutIfAbsent is AddUnique, named to go with Upsert and CompareAndSwap
+func (db *DB) PutIfAbsent(key Hash, value []byte) (bool, error) {
+	return db.PutIfAbsentContext(context.Background(), key, value)
+}
+
+func (db *DB) PutIfAbsentContext(ctx context.Context, key Hash, value []byte) (bool, error) {
+	return db.AddUniqueContext(ctx, key, value)
+}
+
+// CompareAndSwap replaces the value of key only if the SHA-512 half of
+// its current value is old, and returns whether it was replaced
+func (db *DB) CompareAndSwap(key, old Hash, value []byte) (bool, error) {
+	return db.CompareAndSwapContext(context.Background(), key, old, value)
+}
+
+func (db *DB) CompareAndSwapContext(ctx context.Context, key, old Hash, value []byte) (bool, error) {
+	if err := db.checkContent(key, value); err != nil {
+		return false, err
+	}
+	lock := db.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	current, err := db.GetContext(ctx, key)
+	switch {
+	case err == ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	case SHA512Half.HashKey(current.Value) != old:
+		return false, nil
+	}
+	return true, db.add(ctx, key, current.RawKey, value, true)
+}
+
+// Latest reports for each of kvs, as returned by Scan, whether it is the
+// value its key will refer to once the buffered keys are flushed. A
+// replica applying values in the order they were appended makes the same
+// changes by upserting the latest values and adding the others only if
+// absent.
+func (db *DB) Latest(kvs []*KeyValue) ([]bool, error) {
+	return db.LatestContext(context.Background(), kvs)
+}
+
+func (db *DB) LatestContext(ctx context.Context, kvs []*KeyValue) ([]bool, error) {
+	// Keys move from the buffer to the tree under flushLock
+	db.compactLock.RLock()
+	defer db.compactLock.RUnlock()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	latest := make([]bool, len(kvs))
+	for i, kv := range kvs {
+		buffered, replace := db.buffer.Lookup(kv.Hash)
+		if buffered != nil && replace {
+			latest[i] = buffered.Id == kv.Id
+			continue
+		}
+		var key *Key
+		if db.mayHave(kv.Hash) {
+			var err error
+			switch key, err = db.tree.GetContext(ctx, kv.Hash); err {
+			case nil, ErrNotFound:
+			default:
+				return nil, err
+			}
+		}
+		// Buffered keys only take the place of missing ones
+		if key == nil {
+			key = buffered
+		}
+		latest[i] = key != nil && key.Id == kv.Id
+	}
+	return latest, nil
+}
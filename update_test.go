@@ -0,0 +1,117 @@
+package keyvadb
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *KeyVaSuite) TestUpsert(c *C) {
+	commits := 0
+	hooks := Hooks{OnJournalCommit: func([]Delta) { commits++ }}
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, FlushInterval: time.Hour, Hooks: hooks})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(300)
+	c.Assert(err, IsNil)
+	updates, err := gen.Take(100)
+	c.Assert(err, IsNil)
+	for _, kv := range kvs {
+		c.Assert(db.Add(kv.Hash, kv.Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	// Plain Adds of existing keys leave the values unchanged
+	for i, kv := range kvs[:100] {
+		c.Assert(db.Add(kv.Hash, updates[i].Value), IsNil)
+	}
+	c.Assert(db.Flush(), IsNil)
+	for i, kv := range kvs[:100] {
+		c.Assert(db.Upsert(kv.Hash, updates[i].Value), IsNil)
+		found, err := db.Get(kv.Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.Value, DeepEquals, updates[i].Value)
+	}
+	c.Assert(db.Upsert(updates[0].Hash, updates[0].Value), IsNil)
+	// A later Add of an upserted key leaves the value in the tree
+	c.Assert(db.Upsert(kvs[150].Hash, updates[4].Value), IsNil)
+	c.Assert(db.Add(kvs[150].Hash, updates[5].Value), IsNil)
+	// New keys and replacements are committed together
+	commits = 0
+	c.Assert(db.Flush(), IsNil)
+	c.Assert(commits, Equals, 1)
+	check := func() {
+		for i, kv := range kvs {
+			found, err := db.Get(kv.Hash)
+			c.Assert(err, IsNil)
+			if i < 100 {
+				c.Assert(found.Value, DeepEquals, updates[i].Value)
+			} else {
+				c.Assert(found.Value, DeepEquals, kv.Value)
+			}
+		}
+		found, err := db.Get(updates[0].Hash)
+		c.Assert(err, IsNil)
+		c.Assert(found.Value, DeepEquals, updates[0].Value)
+	}
+	check()
+	c.Assert(db.Verify(nil), IsNil)
+	c.Assert(db.Compact(nil), IsNil)
+	c.Assert(db.values.Length(), Equals, int64(301))
+	check()
+
+	added, err := db.PutIfAbsent(kvs[0].Hash, kvs[0].Value)
+	c.Assert(err, IsNil)
+	c.Assert(added, Equals, false)
+	// Generated values are keyed by their digests
+	key := kvs[200].Hash
+	swapped, err := db.CompareAndSwap(key, kvs[200].Hash, updates[1].Value)
+	c.Assert(err, IsNil)
+	c.Assert(swapped, Equals, true)
+	swapped, err = db.CompareAndSwap(key, kvs[200].Hash, updates[2].Value)
+	c.Assert(err, IsNil)
+	c.Assert(swapped, Equals, false)
+	c.Assert(db.Flush(), IsNil)
+	swapped, err = db.CompareAndSwap(key, updates[1].Hash, updates[2].Value)
+	c.Assert(err, IsNil)
+	c.Assert(swapped, Equals, true)
+	c.Assert(db.Flush(), IsNil)
+	found, err := db.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(found.Value, DeepEquals, updates[2].Value)
+	swapped, err = db.CompareAndSwap(updates[3].Hash, EmptyKey, updates[3].Value)
+	c.Assert(err, IsNil)
+	c.Assert(swapped, Equals, false)
+}
+
+func (s *KeyVaSuite) TestLatest(c *C) {
+	db, err := Open("", &Options{InMemory: true, Degree: 10, BatchSize: 100, FlushInterval: time.Hour})
+	c.Assert(err, IsNil)
+	gen := NewRandomValueGenerator(10, 40, s.R)
+	kvs, err := gen.Take(4)
+	c.Assert(err, IsNil)
+	a, b, d := kvs[0].Hash, kvs[1].Hash, kvs[2].Hash
+	c.Assert(db.Add(a, kvs[0].Value), IsNil)
+	c.Assert(db.Add(b, kvs[1].Value), IsNil)
+	c.Assert(db.Flush(), IsNil)
+	// A plain Add of an existing key, an Upsert and two Adds of a new key,
+	// which are judged the same before and after they are flushed
+	c.Assert(db.Add(a, kvs[3].Value), IsNil)
+	c.Assert(db.Upsert(b, kvs[3].Value), IsNil)
+	c.Assert(db.Add(d, kvs[0].Value), IsNil)
+	c.Assert(db.Add(d, kvs[1].Value), IsNil)
+	want := []bool{true, false, false, true, false, true}
+	for _, flush := range []bool{false, true} {
+		if flush {
+			c.Assert(db.Flush(), IsNil)
+		}
+		var values []*KeyValue
+		_, err = db.Scan(0, func(kv *KeyValue) error {
+			values = append(values, kv)
+			return nil
+		})
+		c.Assert(err, IsNil)
+		latest, err := db.Latest(values)
+		c.Assert(err, IsNil)
+		c.Assert(latest, DeepEquals, want)
+	}
+}
@@ -0,0 +1,69 @@
+package keyvadb
+
+import "fmt"
+
+// Cache of values by id. Values are shared between callers and must
+// not be modified.
+type ValueCache struct {
+	shardedCache
+}
+
+func NewValueCache(capacity int64, shards int) *ValueCache {
+	return &ValueCache{newShardedCache(capacity, shards)}
+}
+
+func (c *ValueCache) Get(id ValueId) *KeyValue {
+	if kv, ok := c.shard(uint64(id)).get(uint64(id)); ok {
+		return kv.(*KeyValue)
+	}
+	return nil
+}
+
+func (c *ValueCache) Add(id ValueId, kv *KeyValue) {
+	c.shard(uint64(id)).set(uint64(id), kv, int64(SizeOfKeyValue(kv.Value)), false)
+}
+
+func (c *ValueCache) String() string {
+	return fmt.Sprintf("Value Cache: %s", c.Total())
+}
+
+// Serves Gets of recently read values from memory. Appended values are
+// not cached until they are first read. Get returns copies of the cached
+// values so that callers may modify them.
+type CachedValueStore struct {
+	ValueStore
+	cache *ValueCache
+}
+
+func NewCachedValueStore(values ValueStore, capacity int64) *CachedValueStore {
+	return &CachedValueStore{
+		ValueStore: values,
+		cache:      NewValueCache(capacity, cacheShards),
+	}
+}
+
+func (s *CachedValueStore) Get(id ValueId) (*KeyValue, error) {
+	if kv := s.cache.Get(id); kv != nil {
+		return kv.Clone(), nil
+	}
+	kv, err := s.ValueStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.Add(id, kv)
+	return kv.Clone(), nil
+}
+
+// Compaction moves values so the cache is emptied afterwards
+func (s *CachedValueStore) Compact(f func(ValueStore) error, commit func() error) error {
+	defer s.cache.clear()
+	return s.ValueStore.Compact(f, commit)
+}
+
+func (s *CachedValueStore) CacheStats() []CacheStats {
+	return s.cache.Stats()
+}
+
+func (s *CachedValueStore) String() string {
+	return fmt.Sprintf("%s %s", s.ValueStore, s.cache)
+}